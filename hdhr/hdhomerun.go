@@ -19,6 +19,12 @@ type Stream struct {
 func DiscoverHandler(c *gin.Context) {
 	host := c.Request.Host
 
+	tunerCount, err := management.GetTunerCount()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"FriendlyName":    "muxpie",
 		"Manufacturer":    "Silicondust",
@@ -29,6 +35,7 @@ func DiscoverHandler(c *gin.Context) {
 		"DeviceAuth":      "test1234",
 		"BaseURL":         "http://" + host,
 		"LineupURL":       "http://" + host + "/lineup.json",
+		"TunerCount":      tunerCount,
 	})
 }
 
@@ -60,7 +67,9 @@ func LineupHandler(c *gin.Context) {
 		channels := category.Channels
 		for _, channel := range channels {
 			var streamURL string
-			if category.Playlist.Restream {
+			if category.Playlist.Passthrough {
+				streamURL = fmt.Sprintf("%s://%s/stream/%d.%s", scheme, c.Request.Host, channel.ID, "ts")
+			} else if category.Playlist.Restream {
 				streamURL = fmt.Sprintf("%s://%s/hls/%d.%s", scheme, c.Request.Host, channel.ID, "ts")
 			} else {
 				// Use StreamURL from the database when Restream is false
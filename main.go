@@ -3,11 +3,46 @@ package main
 import (
 	"livestream-companion/management"
 	"livestream-companion/routes"
+	"livestream-companion/stream"
+	"os"
+	"strconv"
 	"time"
 )
 
 func main() {
+	// Seconds without data before a live stream is restarted or failed over
+	if stallTimeout, err := strconv.Atoi(os.Getenv("STALL_TIMEOUT")); err == nil {
+		stream.StallTimeout = time.Duration(stallTimeout) * time.Second
+	}
+
+	// Minutes of live TV kept on disk for players asking for timeshift
+	if timeshiftWindow, err := strconv.Atoi(os.Getenv("TIMESHIFT_WINDOW")); err == nil {
+		stream.TimeshiftWindow = time.Duration(timeshiftWindow) * time.Minute
+	}
+
+	// Where recordings go and the minutes of padding they get by default
+	if recordingsDir := os.Getenv("RECORDINGS_DIR"); recordingsDir != "" {
+		management.RecordingsDir = recordingsDir
+	}
+	if prePadding, err := strconv.Atoi(os.Getenv("RECORDING_PRE_PADDING")); err == nil {
+		management.DefaultPrePadding = prePadding
+	}
+	if postPadding, err := strconv.Atoi(os.Getenv("RECORDING_POST_PADDING")); err == nil {
+		management.DefaultPostPadding = postPadding
+	}
+
+	if strmDir := os.Getenv("STRM_DIR"); strmDir != "" {
+		management.StrmDir = strmDir
+	}
+
+	// Seconds between two scheduled playlist imports
+	if refreshStagger, err := strconv.Atoi(os.Getenv("REFRESH_STAGGER")); err == nil {
+		management.RefreshStagger = time.Duration(refreshStagger) * time.Second
+	}
+
 	management.InitializeDatabase()
+	go management.RunRecordings()
+	go management.RunScheduledRefresh()
 	go func() {
 		for {
 			management.UpdateDBEPG(true) // Pass true to check the last processed time
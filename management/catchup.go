@@ -0,0 +1,57 @@
+package management
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// HasCatchup reports whether the provider keeps an archive of the channel that
+// we can play. Only Xtream panels have a timeshift API, so the channel must
+// have its Category.Playlist loaded.
+func (c *Channel) HasCatchup() bool {
+	return c.Category.Playlist.Type == "xcode" && c.TvArchive > 0 && c.TvArchiveDuration > 0
+}
+
+// CatchupAvailable reports whether a programme starting at start is still in
+// the archive of the channel.
+func (c *Channel) CatchupAvailable(start time.Time) bool {
+	if !c.HasCatchup() {
+		return false
+	}
+
+	oldest := time.Now().AddDate(0, 0, -int(c.TvArchiveDuration))
+	return start.After(oldest) && start.Before(time.Now())
+}
+
+// CatchupURL builds the Xtream timeshift URL playing duration minutes of the
+// channel archive from start. The channel must have its Category.Playlist loaded.
+func CatchupURL(channel *Channel, start time.Time, duration int) (string, error) {
+	playlist := channel.Category.Playlist
+	if playlist.Type != "xcode" {
+		return "", errors.New("catch-up is only available on Xtream playlists")
+	}
+	if !channel.CatchupAvailable(start) {
+		return "", errors.New("the programme is not in the channel archive")
+	}
+	if duration <= 0 {
+		return "", errors.New("the duration must be a positive number of minutes")
+	}
+
+	// The panel expects the start in its own time zone
+	location := time.UTC
+	if xtreamInfo, err := GetXtreamServerInfo(&playlist); err == nil && xtreamInfo.ServerInfo.Timezone != "" {
+		if serverLocation, err := time.LoadLocation(xtreamInfo.ServerInfo.Timezone); err == nil {
+			location = serverLocation
+		}
+	}
+
+	return fmt.Sprintf("%s/timeshift/%s/%s/%d/%s/%d.ts", playlist.Server, playlist.Username, playlist.Password,
+		duration, start.In(location).Format("2006-01-02:15-04"), channel.StreamID), nil
+}
+
+// catchupPath is the path of our own catch-up endpoint for a programme.
+func catchupPath(channel *Channel, start time.Time, stop time.Time) string {
+	duration := int(stop.Sub(start).Round(time.Minute).Minutes())
+	return fmt.Sprintf("/catchup/%d?start=%d&duration=%d", channel.ID, start.Unix(), duration)
+}
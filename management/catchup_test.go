@@ -0,0 +1,72 @@
+package management
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestExportedCatchupMatchesCatchupURL(t *testing.T) {
+	openTestDB(t)
+
+	start := time.Now().Add(-2 * time.Hour).UTC()
+	stop := start.Add(time.Hour)
+
+	for i, playlistType := range []string{"xcode", "m3u"} {
+		playlist := Playlist{Type: playlistType, Server: "http://provider", Username: "user", Password: "pass"}
+		if err := DB.Create(&playlist).Error; err != nil {
+			t.Fatal(err)
+		}
+		category := Category{PlaylistID: playlist.ID, CategoryName: playlistType, Active: true}
+		if err := DB.Create(&category).Error; err != nil {
+			t.Fatal(err)
+		}
+		channel := Channel{
+			ID:                i + 1,
+			Name:              playlistType,
+			CategoryID:        category.ID,
+			StreamID:          100 + i,
+			HDHRChannelNum:    i + 1,
+			TvArchive:         1,
+			TvArchiveDuration: 7,
+			Active:            true,
+		}
+		if err := DB.Create(&channel).Error; err != nil {
+			t.Fatal(err)
+		}
+		programme := Programme{
+			ChannelID: channel.ID,
+			Title:     "Past " + playlistType,
+			Start:     start.Format("20060102150405 -0700"),
+			Stop:      stop.Format("20060102150405 -0700"),
+		}
+		if err := DB.Create(&programme).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	guide, err := ExportDBEPGToXML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bytes.Count(guide, []byte("catchup-id=")); got != 1 {
+		t.Errorf("%d programmes advertise catch-up, want 1:\n%s", got, guide)
+	}
+
+	for _, test := range []struct {
+		id        int
+		advertise bool
+	}{
+		{1, true},
+		{2, false},
+	} {
+		var channel Channel
+		if err := DB.Preload("Category.Playlist").First(&channel, test.id).Error; err != nil {
+			t.Fatal(err)
+		}
+		_, err := CatchupURL(&channel, start, 60)
+		if channel.CatchupAvailable(start) != test.advertise || (err == nil) != test.advertise {
+			t.Errorf("%s channel: available %v, URL error %v", channel.Name, channel.CatchupAvailable(start), err)
+		}
+	}
+}
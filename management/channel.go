@@ -13,8 +13,14 @@ func (c *Channel) Save() error {
 
 func (c *Channel) Update() error {
 	result := DB.Model(&Channel{}).Where("id = ?", c.ID).UpdateColumns(map[string]interface{}{
-		"Active": c.Active,
-		"Name":   c.Name,
+		"Active":             c.Active,
+		"Name":               c.Name,
+		"TranscodeProfileID": c.TranscodeProfileID,
+		"FailoverGroup":      c.FailoverGroup,
+		"FailoverPriority":   c.FailoverPriority,
+		"EpgChannelID":       c.EpgChannelID,
+		"EpgSourceID":        c.EpgSourceID,
+		"CustomEpg":          c.CustomEpg,
 	})
 
 	if result.Error != nil {
@@ -69,6 +75,16 @@ func GetChannelByID(id uint) (*Channel, error) {
 	return &channel, nil
 }
 
+func GetChannelWithPlaylistByID(id uint) (*Channel, error) {
+	var channel Channel
+	result := DB.Preload("Category.Playlist").First(&channel, id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &channel, nil
+}
+
 func GetChannelsByEpgId(epgId string) ([]*Channel, error) {
 	var channels []*Channel
 	result := DB.Where("epg_channel_id = ?", epgId).Find(&channels)
@@ -217,3 +233,13 @@ func GetProgrammesByChannelID(channelID uint) ([]Programme, error) {
 
 	return programmes, nil
 }
+
+func GetProgrammeByID(id uint) (*Programme, error) {
+	var programme Programme
+	result := DB.First(&programme, id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &programme, nil
+}
@@ -1,12 +1,15 @@
 package management
 
 import (
-	"context"
+	"errors"
+	"fmt"
 	"livestream-companion/stream"
+	"log"
 	"net/http"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -44,6 +47,10 @@ func InsertPlaylistHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if _, err := ParseSchedule(playlist.RefreshSchedule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	// Save the new playlist
 	if err := playlist.Save(); err != nil {
@@ -51,7 +58,7 @@ func InsertPlaylistHandler(c *gin.Context) {
 		return
 	}
 
-	go ImportXtream(c, playlist.ID)
+	go ImportPlaylist(playlist.ID)
 
 	c.JSON(http.StatusOK, playlist)
 }
@@ -78,6 +85,10 @@ func UpdatePlaylistByIDHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if _, err := ParseSchedule(playlist.RefreshSchedule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	// Save the updated playlist
 	if err := playlist.Update(); err != nil {
@@ -85,7 +96,7 @@ func UpdatePlaylistByIDHandler(c *gin.Context) {
 		return
 	}
 
-	go ImportXtream(c, playlist.ID)
+	go ImportPlaylist(playlist.ID)
 
 	c.JSON(http.StatusOK, playlist)
 }
@@ -116,6 +127,97 @@ func DeletePlaylistByIDHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"status": "success"})
 }
 
+func UploadM3uHandler(c *gin.Context) {
+	// Parse id from path parameters
+	idStr := c.Param("id")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	idUInt := uint(idInt)
+
+	// Check if playlist exists
+	playlist, err := GetPlaylistByID(idUInt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if playlist.Type != "m3u" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only m3u playlists can be uploaded"})
+		return
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer file.Close()
+
+	count, err := StoreM3u(playlist.ID, file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The uploaded file replaces the URL as the source of the playlist
+	if playlist.M3uURL != "" {
+		playlist.M3uURL = ""
+		if err := playlist.Update(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	go ImportPlaylist(playlist.ID)
+
+	c.JSON(http.StatusOK, gin.H{"status": "success", "streams": count})
+}
+
+func GetImportJobsByPlaylistIDHandler(c *gin.Context) {
+	idStr := c.Param("id")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	jobs, err := GetImportJobsByPlaylistID(uint(idInt))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, jobs)
+}
+
+func GetImportProgressHandler(c *gin.Context) {
+	idStr := c.Param("id")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	job, err := GetImportProgress(uint(idInt))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if job == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "The playlist was never imported"})
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
 func GetCategoriesHandler(c *gin.Context) {
 	categories, err := GetCategories()
 	if err != nil {
@@ -256,12 +358,25 @@ func UpdateChannelByIDHandler(c *gin.Context) {
 		return
 	}
 
+	epgChannelID, epgSourceID := channel.EpgChannelID, channel.EpgSourceID
+
 	// Bind JSON body to channel
 	if err := c.ShouldBindJSON(&channel); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	// A mapping set by hand is kept over the EPG ID of the provider
+	if channel.EpgChannelID != epgChannelID || channel.EpgSourceID != epgSourceID {
+		channel.CustomEpg = true
+	}
+	if channel.EpgSourceID != 0 {
+		if _, err := GetEpgSourceByID(channel.EpgSourceID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown EPG source"})
+			return
+		}
+	}
+
 	// Save the updated channel
 	if err := channel.Update(); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -362,8 +477,8 @@ func UpdateActiveChannelsByCategoryIDHandler(c *gin.Context) {
 }
 
 func RestreamingHandler(c *gin.Context) {
-	// Parse id from path parameters
-	idStr := c.Param("id")
+	// Parse id from path parameters, /stream/<id>.ts
+	idStr := strings.TrimSuffix(c.Param("id"), ".ts")
 	idInt, err := strconv.Atoi(idStr)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
@@ -372,43 +487,173 @@ func RestreamingHandler(c *gin.Context) {
 	idUInt := uint(idInt)
 
 	// Fetch the channel by ID
-	channel, err := GetChannelByID(idUInt)
+	channel, err := GetChannelWithPlaylistByID(idUInt)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Start restreaming the channel
-	println("channel.StreamURL: ", channel.StreamURL)
-	err = stream.StartRestreaming(context.Background(), channel.StreamURL, c.Writer)
+	failover, err := GetFailoverSources(channel)
 	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
+
+	// Start restreaming the channel, the session ends when the client leaves
+	stream.HandleTS(c, stream.Tune{
+		Source:      channelSource(channel),
+		Failover:    failover,
+		Profile:     stream.PassthroughProfile,
+		Passthrough: true,
+	})
 }
 
 func StreamHandler(c *gin.Context) {
-	base := filepath.Base(c.Param("path"))             // Get the last element of the path
+	path := strings.Trim(c.Param("path"), "/")
+
+	// Old clients still ask for a profile with the webbrowser parameter
+	profileName := c.Query("profile")
+	switch c.Query("webbrowser") {
+	case "true":
+		profileName = "webbrowser"
+	case "lq":
+		profileName = "lq"
+	}
+
+	timeshift, err := timeshiftWindow(c.Query("timeshift"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timeshift"})
+		return
+	}
+
+	// Segments of an HLS session: /hls/<id>/<n>.ts
+	if dir, segment := filepath.Split(path); dir != "" {
+		stream.HandleHLSSegment(c, strings.TrimSuffix(dir, "/"), profileName, timeshift, c.Query("variant"), segment)
+		return
+	}
+
+	base := filepath.Base(path)                        // Get the last element of the path
 	id := strings.TrimSuffix(base, filepath.Ext(base)) // Remove the extension
 
-	if strings.HasSuffix(c.Param("path"), ".ts") {
-		idInt, err := strconv.Atoi(id)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
-			return
-		}
-		idUInt := uint(idInt)
+	if !strings.HasSuffix(path, ".ts") && !strings.HasSuffix(path, ".m3u8") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown stream format"})
+		return
+	}
 
-		// Fetch the channel by ID
-		channel, err := GetChannelByID(idUInt)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
+	idInt, err := strconv.Atoi(id)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	idUInt := uint(idInt)
+
+	// Fetch the channel by ID
+	channel, err := GetChannelWithPlaylistByID(idUInt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	profile, err := ResolveTranscodeProfile(profileName, channel)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown profile " + profileName})
+		return
+	}
+
+	failover, err := GetFailoverSources(channel)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	tune := stream.Tune{
+		Source:   channelSource(channel),
+		Failover: failover,
+		Profile:  profile.StreamProfile(),
+	}
 
-		webbrowser := c.DefaultQuery("webbrowser", "false")
-		stream.HandleTS(c, channel.StreamURL, id, webbrowser)
+	if strings.HasSuffix(path, ".m3u8") {
+		tune.Timeshift = timeshift
+		stream.HandleHLSPlaylist(c, tune)
+	} else {
+		// HLS needs ffmpeg to cut segments, a plain TS can be relayed
+		usePassthrough(&tune, channel, profileName)
+		stream.HandleTS(c, tune)
 	}
+}
+
+// CatchupHandler plays a past programme from the provider archive:
+// /catchup/<id>?start=<unix>&duration=<minutes>
+func CatchupHandler(c *gin.Context) {
+	idStr := strings.TrimSuffix(c.Param("id"), ".ts")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	idUInt := uint(idInt)
+
+	startUnix, err := strconv.ParseInt(c.Query("start"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start"})
+		return
+	}
+	duration, err := strconv.Atoi(c.Query("duration"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid duration"})
+		return
+	}
+
+	channel, err := GetChannelWithPlaylistByID(idUInt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	url, err := CatchupURL(channel, time.Unix(startUnix, 0), duration)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	profile, err := ResolveTranscodeProfile(c.Query("profile"), channel)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown profile " + c.Query("profile")})
+		return
+	}
+
+	// Everyone asking for the same programme shares one provider connection
+	source := channelSource(channel)
+	source.InputURL = url
+	tune := stream.Tune{
+		Source:  source,
+		Profile: profile.StreamProfile(),
+		Variant: fmt.Sprintf("catchup%d-%d", startUnix, duration),
+	}
+	usePassthrough(&tune, channel, c.Query("profile"))
+	stream.HandleTS(c, tune)
+}
 
+// timeshiftWindow parses the timeshift query parameter, either a boolean for
+// the default window or a number of minutes no longer than it.
+func timeshiftWindow(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	if minutes, err := strconv.Atoi(value); err == nil {
+		window := time.Duration(minutes) * time.Minute
+		if window < 0 || window > stream.TimeshiftWindow {
+			return 0, fmt.Errorf("timeshift must be between 0 and %d minutes", int(stream.TimeshiftWindow.Minutes()))
+		}
+		return window, nil
+	}
+
+	enabled, err := strconv.ParseBool(value)
+	if err != nil || !enabled {
+		return 0, err
+	}
+	return stream.TimeshiftWindow, nil
 }
 
 func GetEPG(c *gin.Context) {
@@ -498,6 +743,51 @@ func GetChannelsWithNoEpgByPlaylistIdHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, channels)
 }
 
+func GetEpgSuggestionsHandler(c *gin.Context) {
+	var playlistID uint
+	if playlistIDStr := c.Query("playlist_id"); playlistIDStr != "" {
+		playlistIDInt, err := strconv.Atoi(playlistIDStr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid playlist ID"})
+			return
+		}
+		playlistID = uint(playlistIDInt)
+	}
+
+	minScore := DefaultEpgMatchScore
+	if minScoreStr := c.Query("min_score"); minScoreStr != "" {
+		var err error
+		minScore, err = strconv.ParseFloat(minScoreStr, 64)
+		if err != nil || minScore < 0 || minScore > 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "min_score must be between 0 and 1"})
+			return
+		}
+	}
+
+	suggestions, err := GetEpgSuggestions(playlistID, minScore)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, suggestions)
+}
+
+func AcceptEpgSuggestionsHandler(c *gin.Context) {
+	var suggestions []EpgSuggestion
+	if err := c.ShouldBindJSON(&suggestions); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := AcceptEpgSuggestions(suggestions); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success", "channels": len(suggestions)})
+}
+
 func UpdateHDHRChannelNumForAllChannelsHandler(c *gin.Context) {
 	err := UpdateHDHRChannelNumForAllChannels()
 	if err != nil {
@@ -544,3 +834,782 @@ func GetProgrammesByChannelIDHandler(c *gin.Context) {
 	}
 	c.JSON(http.StatusOK, programmes)
 }
+
+func GetTranscodeProfilesHandler(c *gin.Context) {
+	profiles, err := GetTranscodeProfiles()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, profiles)
+}
+
+func GetTranscodeProfileByIDHandler(c *gin.Context) {
+	idStr := c.Param("id")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	idUInt := uint(idInt)
+
+	profile, err := GetTranscodeProfileByID(idUInt)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, profile)
+}
+
+func InsertTranscodeProfileHandler(c *gin.Context) {
+	var profile TranscodeProfile
+
+	// Bind JSON body to profile
+	if err := c.ShouldBindJSON(&profile); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Save the new profile
+	if err := profile.Save(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, profile)
+}
+
+func UpdateTranscodeProfileByIDHandler(c *gin.Context) {
+	// Parse id from path parameters
+	idStr := c.Param("id")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	idUInt := uint(idInt)
+
+	// Check if profile exists
+	profile, err := GetTranscodeProfileByID(idUInt)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Bind JSON body to profile
+	if err := c.ShouldBindJSON(&profile); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	profile.ID = idUInt
+
+	// Save the updated profile
+	if err := profile.Update(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, profile)
+}
+
+func DeleteTranscodeProfileByIDHandler(c *gin.Context) {
+	// Parse id from path parameters
+	idStr := c.Param("id")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	idUInt := uint(idInt)
+
+	// Check if profile exists
+	profile, err := GetTranscodeProfileByID(idUInt)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Delete the profile
+	if err := profile.Delete(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+func GetFailoverGroupsHandler(c *gin.Context) {
+	groups, err := GetFailoverGroups()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, groups)
+}
+
+func GetFailoverGroupHandler(c *gin.Context) {
+	manual := c.Param("kind") == "group"
+	if !manual && c.Param("kind") != "epg" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown group kind"})
+		return
+	}
+
+	group, err := GetFailoverGroup(c.Param("name"), manual)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, group)
+}
+
+func UpdateFailoverGroupHandler(c *gin.Context) {
+	manual := c.Param("kind") == "group"
+	if !manual && c.Param("kind") != "epg" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown group kind"})
+		return
+	}
+
+	// Bind JSON body with the channels in priority order
+	type bodyData struct {
+		ChannelIDs []int `json:"ChannelIDs"`
+	}
+	var data bodyData
+
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Update the group
+	if err := UpdateFailoverGroup(c.Param("name"), manual, data.ChannelIDs); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	group, err := GetFailoverGroup(c.Param("name"), manual)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, group)
+}
+
+func GetStreamSessionsHandler(c *gin.Context) {
+	sessions, err := GetStreamSessions()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, sessions)
+}
+
+func DeleteStreamSessionHandler(c *gin.Context) {
+	if !stream.Kill(c.Param("id")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+func GetRecordingsHandler(c *gin.Context) {
+	recordings, err := GetRecordings()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, recordings)
+}
+
+func GetRecordingByIDHandler(c *gin.Context) {
+	idStr := c.Param("id")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	idUInt := uint(idInt)
+
+	recording, err := GetRecordingByID(idUInt)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, recording)
+}
+
+// GetRecordingFileHandler downloads the recorded stream.
+func GetRecordingFileHandler(c *gin.Context) {
+	idStr := c.Param("id")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	idUInt := uint(idInt)
+
+	recording, err := GetRecordingByID(idUInt)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	if recording.FilePath == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Nothing recorded yet"})
+		return
+	}
+
+	path, err := recording.File()
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "video/mp2t")
+	c.FileAttachment(path, filepath.Base(path))
+}
+
+func InsertRecordingHandler(c *gin.Context) {
+	recording := Recording{
+		PrePadding:  DefaultPrePadding,
+		PostPadding: DefaultPostPadding,
+	}
+
+	// Bind JSON body to recording, padding the request leaves out keeps the default
+	if err := c.ShouldBindJSON(&recording); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	recording.ID = 0
+
+	if err := recording.Schedule(); err != nil {
+		recordingError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, recording)
+}
+
+func UpdateRecordingByIDHandler(c *gin.Context) {
+	idStr := c.Param("id")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	idUInt := uint(idInt)
+
+	recording, err := GetRecordingByID(idUInt)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	status, filePath, size, recordingErr := recording.Status, recording.FilePath, recording.Size, recording.Error
+
+	if err := c.ShouldBindJSON(&recording); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	recording.ID = idUInt
+	recording.Status, recording.FilePath, recording.Size, recording.Error = status, filePath, size, recordingErr
+
+	if err := recording.Update(); err != nil {
+		recordingError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, recording)
+}
+
+func DeleteRecordingByIDHandler(c *gin.Context) {
+	idStr := c.Param("id")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	idUInt := uint(idInt)
+
+	recording, err := GetRecordingByID(idUInt)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := recording.Delete(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+// recordingError answers with the conflicting recordings when there are no
+// tuners left, or a bad request otherwise.
+func recordingError(c *gin.Context, err error) {
+	var conflict *RecordingConflictError
+	if errors.As(err, &conflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "conflicts": conflict.Conflicts})
+		return
+	}
+
+	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+}
+
+func GetRecordingRulesHandler(c *gin.Context) {
+	rules, err := GetRecordingRules()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, rules)
+}
+
+func GetRecordingRuleByIDHandler(c *gin.Context) {
+	idStr := c.Param("id")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	idUInt := uint(idInt)
+
+	rule, err := GetRecordingRuleByID(idUInt)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, rule)
+}
+
+func InsertRecordingRuleHandler(c *gin.Context) {
+	rule := RecordingRule{
+		PrePadding:  DefaultPrePadding,
+		PostPadding: DefaultPostPadding,
+		Active:      true,
+	}
+
+	// Bind JSON body to rule, fields the request leaves out keep the default
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rule.ID = 0
+
+	if err := rule.Save(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Schedule what the current guide already has
+	if rule.Active {
+		if err := rule.Apply(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, rule)
+}
+
+func UpdateRecordingRuleByIDHandler(c *gin.Context) {
+	idStr := c.Param("id")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	idUInt := uint(idInt)
+
+	rule, err := GetRecordingRuleByID(idUInt)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rule.ID = idUInt
+
+	if err := rule.Update(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if rule.Active {
+		if err := rule.Apply(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, rule)
+}
+
+func DeleteRecordingRuleByIDHandler(c *gin.Context) {
+	idStr := c.Param("id")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	idUInt := uint(idInt)
+
+	rule, err := GetRecordingRuleByID(idUInt)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := rule.Delete(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+func GetEpgSourcesHandler(c *gin.Context) {
+	sources, err := GetEpgSources()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, sources)
+}
+
+func GetEpgSourceByIDHandler(c *gin.Context) {
+	idStr := c.Param("id")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	idUInt := uint(idInt)
+
+	source, err := GetEpgSourceByID(idUInt)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, source)
+}
+
+func InsertEpgSourceHandler(c *gin.Context) {
+	var source EpgSource
+
+	if err := c.ShouldBindJSON(&source); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	source.ID = 0
+
+	if err := source.Save(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	go source.Refresh()
+
+	c.JSON(http.StatusOK, source)
+}
+
+func UpdateEpgSourceByIDHandler(c *gin.Context) {
+	idStr := c.Param("id")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	idUInt := uint(idInt)
+
+	source, err := GetEpgSourceByID(idUInt)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := c.ShouldBindJSON(&source); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	source.ID = idUInt
+
+	if err := source.Update(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	go source.Refresh()
+
+	c.JSON(http.StatusOK, source)
+}
+
+func DeleteEpgSourceByIDHandler(c *gin.Context) {
+	idStr := c.Param("id")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	idUInt := uint(idInt)
+
+	source, err := GetEpgSourceByID(idUInt)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := source.Delete(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+func RefreshEpgSourceHandler(c *gin.Context) {
+	idStr := c.Param("id")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	idUInt := uint(idInt)
+
+	source, err := GetEpgSourceByID(idUInt)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	go source.Refresh()
+
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+func GetEpgChannelsBySourceIDHandler(c *gin.Context) {
+	idStr := c.Param("id")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	channels, err := GetEpgChannelsBySourceID(uint(idInt))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, channels)
+}
+
+// requestBaseURL is how the client reached us, to build links back to the server.
+func requestBaseURL(c *gin.Context) string {
+	scheme := "http"
+	if forwardedProto := c.GetHeader("X-Forwarded-Proto"); forwardedProto != "" {
+		scheme = forwardedProto
+	} else if c.Request.TLS != nil {
+		scheme = "https"
+	}
+
+	return fmt.Sprintf("%s://%s", scheme, c.Request.Host)
+}
+
+func GetVodCategoriesByPlaylistIDHandler(c *gin.Context) {
+	idStr := c.Param("playlist_id")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	idUInt := uint(idInt)
+
+	// Optionally only one kind, ?kind=movie or ?kind=series
+	categories, err := GetVodCategoriesByPlaylistID(idUInt, c.Query("kind"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, categories)
+}
+
+func UpdateVodCategoryByIDHandler(c *gin.Context) {
+	idStr := c.Param("id")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	idUInt := uint(idInt)
+
+	category, err := GetVodCategoryByID(idUInt)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := c.ShouldBindJSON(&category); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	category.ID = idUInt
+
+	if err := category.Update(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Episodes are only imported for active series categories
+	if category.Active {
+		go func() {
+			if err := category.ImportEpisodes(); err != nil {
+				log.Printf("Failed to import episodes of category %d: %v", category.ID, err)
+			}
+		}()
+	}
+
+	c.JSON(http.StatusOK, category)
+}
+
+func GetMoviesByVodCategoryIDHandler(c *gin.Context) {
+	idStr := c.Param("id")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	idUInt := uint(idInt)
+
+	movies, err := GetMoviesByVodCategoryID(idUInt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, movies)
+}
+
+func GetSeriesByVodCategoryIDHandler(c *gin.Context) {
+	idStr := c.Param("id")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	idUInt := uint(idInt)
+
+	series, err := GetSeriesByVodCategoryID(idUInt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, series)
+}
+
+func GetSeriesByIDHandler(c *gin.Context) {
+	idStr := c.Param("id")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	idUInt := uint(idInt)
+
+	series, err := GetSeriesByID(idUInt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, series)
+}
+
+// VodHandler plays a movie, /vod/movie/<id>.<ext>, or an episode,
+// /vod/episode/<id>.<ext>.
+func VodHandler(c *gin.Context) {
+	base := c.Param("id")
+	idStr := strings.TrimSuffix(base, filepath.Ext(base))
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	idUInt := uint(idInt)
+
+	var url string
+	switch c.Param("kind") {
+	case "movie":
+		movie, err := GetMovieByID(idUInt)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		url = movie.StreamURL
+	case "episode":
+		episode, err := GetEpisodeByID(idUInt)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		url = episode.StreamURL
+	default:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown VOD kind"})
+		return
+	}
+
+	stream.HandleVOD(c, url)
+}
+
+func GetVodM3uHandler(c *gin.Context) {
+	idStr := c.Param("playlist_id")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	idUInt := uint(idInt)
+
+	data, err := ExportVodM3u(idUInt, requestBaseURL(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Data(http.StatusOK, "audio/x-mpegurl", data)
+}
+
+func ExportVodStrmHandler(c *gin.Context) {
+	idStr := c.Param("playlist_id")
+	idInt, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	idUInt := uint(idInt)
+
+	count, err := ExportVodStrm(idUInt, requestBaseURL(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success", "files": count})
+}
@@ -0,0 +1,325 @@
+package management
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"gorm.io/gorm"
+)
+
+// DefaultEpgMatchScore is the lowest score of a suggestion, out of 1.
+const DefaultEpgMatchScore = 0.8
+
+// EpgSuggestion is an XMLTV channel whose name looks like the one of a channel
+// without EPG ID. EpgSourceID is 0 when it comes from the guide of the
+// playlist of the channel.
+type EpgSuggestion struct {
+	ChannelID    int
+	ChannelName  string
+	EpgChannelID string
+	EpgSourceID  uint
+	EpgName      string
+	Score        float64
+}
+
+// Prefixes of providers for the country or language, like "ES:", "|UK|" or
+// "FR - ", and tags between brackets, like "[HD]" or "(backup)".
+var channelNamePrefix = regexp.MustCompile(`^\s*(\|[\pL]{2,3}\||[\pL]{2,3}\s*[:|]|[\pL]{2}\s+-\s)`)
+var channelNameTag = regexp.MustCompile(`[\[(][^\])]*[\])]`)
+
+// Words telling the quality of the stream rather than the channel
+var channelQualityTags = map[string]bool{
+	"hd": true, "fhd": true, "uhd": true, "sd": true, "hq": true, "lq": true,
+	"4k": true, "8k": true, "hevc": true, "h264": true, "h265": true,
+	"720p": true, "1080p": true, "1080i": true, "2160p": true,
+	"50fps": true, "60fps": true,
+}
+
+// normalizeChannelName reduces a channel name to the words that name the
+// channel, lowercase, without quality tags and punctuation. "ES: Antena 3 FHD"
+// becomes "antena 3".
+func normalizeChannelName(name string) []string {
+	name = strings.ToLower(name)
+	name = channelNamePrefix.ReplaceAllString(name, "")
+	name = channelNameTag.ReplaceAllString(name, " ")
+
+	words := strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '+'
+	})
+
+	normalized := words[:0]
+	for _, word := range words {
+		if !channelQualityTags[word] {
+			normalized = append(normalized, word)
+		}
+	}
+	return normalized
+}
+
+// nameSimilarity scores two normalized names from 0 to 1 by their edit
+// distance, ignoring spaces so "bbc 1" and "bbc1" are the same.
+func nameSimilarity(a, b string) float64 {
+	ra := []rune(strings.ReplaceAll(a, " ", ""))
+	rb := []rune(strings.ReplaceAll(b, " ", ""))
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	if longest == 0 {
+		return 0
+	}
+
+	return 1 - float64(levenshtein(ra, rb))/float64(longest)
+}
+
+func levenshtein(a, b []rune) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = previous[j-1] + cost
+			if previous[j]+1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
+
+// epgCandidate is a display name of an XMLTV channel, normalized.
+type epgCandidate struct {
+	channel *EpgChannel
+	name    string
+	display string
+}
+
+// epgCandidates indexes the display names of a set of XMLTV channels by word,
+// so a channel is only compared with the names sharing a word with its own.
+type epgCandidates struct {
+	all    []epgCandidate
+	byWord map[string][]int
+	byName map[string][]int
+}
+
+func newEpgCandidates(channels []EpgChannel) *epgCandidates {
+	candidates := &epgCandidates{
+		byWord: make(map[string][]int),
+		byName: make(map[string][]int),
+	}
+
+	for i := range channels {
+		for _, display := range channels[i].DisplayNames {
+			words := normalizeChannelName(display)
+			if len(words) == 0 {
+				continue
+			}
+
+			index := len(candidates.all)
+			name := strings.Join(words, " ")
+			candidates.all = append(candidates.all, epgCandidate{channel: &channels[i], name: name, display: display})
+			key := strings.Join(words, "")
+			candidates.byName[key] = append(candidates.byName[key], index)
+			for _, word := range words {
+				candidates.byWord[word] = append(candidates.byWord[word], index)
+			}
+		}
+	}
+
+	return candidates
+}
+
+// best returns the candidate closest to the normalized words of a channel
+// name, and its score.
+func (c *epgCandidates) best(words []string) (*epgCandidate, float64) {
+	if exact := c.byName[strings.Join(words, "")]; len(exact) > 0 {
+		return &c.all[exact[0]], 1
+	}
+
+	name := strings.Join(words, " ")
+	var best *epgCandidate
+	bestScore := 0.0
+	seen := make(map[int]bool)
+	for _, word := range words {
+		for _, index := range c.byWord[word] {
+			if seen[index] {
+				continue
+			}
+			seen[index] = true
+
+			if score := nameSimilarity(name, c.all[index].name); score > bestScore {
+				best, bestScore = &c.all[index], score
+			}
+		}
+	}
+
+	return best, bestScore
+}
+
+// GetEpgSuggestions suggests an XMLTV channel for each channel without EPG ID,
+// among the guide of its playlist and the EPG sources, when one scores at
+// least minScore. A playlistID of 0 looks at the channels of all playlists.
+func GetEpgSuggestions(playlistID uint, minScore float64) ([]EpgSuggestion, error) {
+	type unmatched struct {
+		ID         int
+		Name       string
+		PlaylistID uint
+	}
+
+	query := DB.Table("channels").
+		Select("channels.id, channels.name, categories.playlist_id").
+		Joins("JOIN categories ON categories.id = channels.category_id").
+		Where("COALESCE(channels.epg_channel_id, '') = ''")
+	if playlistID != 0 {
+		query = query.Where("categories.playlist_id = ?", playlistID)
+	}
+
+	var channels []unmatched
+	if err := query.Order("channels.id").Scan(&channels).Error; err != nil {
+		return nil, err
+	}
+	if len(channels) == 0 {
+		return []EpgSuggestion{}, nil
+	}
+
+	var sourceChannels []EpgChannel
+	if err := DB.Where("epg_source_id <> 0").Find(&sourceChannels).Error; err != nil {
+		return nil, err
+	}
+	sources := newEpgCandidates(sourceChannels)
+
+	playlists := make(map[uint]*epgCandidates)
+	suggestions := []EpgSuggestion{}
+	for _, channel := range channels {
+		words := normalizeChannelName(channel.Name)
+		if len(words) == 0 {
+			continue
+		}
+
+		playlist, ok := playlists[channel.PlaylistID]
+		if !ok {
+			var playlistChannels []EpgChannel
+			if err := DB.Where("playlist_id = ? AND epg_source_id = 0", channel.PlaylistID).Find(&playlistChannels).Error; err != nil {
+				return nil, err
+			}
+			playlist = newEpgCandidates(playlistChannels)
+			playlists[channel.PlaylistID] = playlist
+		}
+
+		// The guide of the playlist wins a tie, it needs no mapping to a source
+		best, score := playlist.best(words)
+		if candidate, sourceScore := sources.best(words); sourceScore > score {
+			best, score = candidate, sourceScore
+		}
+		if best == nil || score < minScore {
+			continue
+		}
+
+		suggestions = append(suggestions, EpgSuggestion{
+			ChannelID:    channel.ID,
+			ChannelName:  channel.Name,
+			EpgChannelID: best.channel.EpgID,
+			EpgSourceID:  best.channel.EpgSourceID,
+			EpgName:      best.display,
+			Score:        score,
+		})
+	}
+
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return suggestions[i].Score > suggestions[j].Score
+	})
+
+	return suggestions, nil
+}
+
+// AcceptEpgSuggestions maps the channels to the XMLTV channels of the
+// suggestions, as a mapping set by hand, and loads their programmes from the
+// guides already downloaded in the background.
+func AcceptEpgSuggestions(suggestions []EpgSuggestion) error {
+	guides := make(map[guide]bool)
+
+	// An import of the guide the channels leave would bring their programmes back
+	mutexEPG.Lock()
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		for _, suggestion := range suggestions {
+			if suggestion.EpgChannelID == "" {
+				return fmt.Errorf("channel %d: missing EPG ID", suggestion.ChannelID)
+			}
+
+			var channel Channel
+			if err := tx.Preload("Category").First(&channel, "id = ?", suggestion.ChannelID).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					return fmt.Errorf("channel %d: not found", suggestion.ChannelID)
+				}
+				return err
+			}
+
+			g := guide{playlistID: channel.Category.PlaylistID}
+			if suggestion.EpgSourceID != 0 {
+				if err := tx.First(&EpgSource{}, suggestion.EpgSourceID).Error; err != nil {
+					return fmt.Errorf("channel %d: unknown EPG source %d", suggestion.ChannelID, suggestion.EpgSourceID)
+				}
+				g = guide{epgSourceID: suggestion.EpgSourceID}
+			}
+			guides[g] = true
+
+			// The programmes the channel had came from the guide it leaves
+			if err := tx.Unscoped().Where("channel_id = ?", channel.ID).Delete(&Programme{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&Channel{}).Where("id = ?", channel.ID).UpdateColumns(map[string]interface{}{
+				"EpgChannelID": suggestion.EpgChannelID,
+				"EpgSourceID":  suggestion.EpgSourceID,
+				"CustomEpg":    true,
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	mutexEPG.Unlock()
+	if err != nil {
+		return err
+	}
+
+	go reloadGuides(guides)
+
+	return nil
+}
+
+// reloadGuides imports again the guides from their last download, for
+// channels newly mapped to them.
+func reloadGuides(guides map[guide]bool) {
+	mutexEPG.Lock()
+	defer mutexEPG.Unlock()
+
+	for g := range guides {
+		if _, err := os.Stat(g.filePath()); err != nil {
+			continue
+		}
+		if err := g.importFile(g.filePath(), nil); err != nil {
+			log.Printf("Failed to reload EPG %s: %v", g.filePath(), err)
+		}
+	}
+
+	ApplyRecordingRules()
+}
@@ -0,0 +1,101 @@
+package management
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeChannelName(t *testing.T) {
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"ES: Antena 3 FHD", []string{"antena", "3"}},
+		{"ES:Antena 3", []string{"antena", "3"}},
+		{"|UK| BBC One HD", []string{"bbc", "one"}},
+		{"UK | BBC One", []string{"bbc", "one"}},
+		{"FR - TF1 (backup)", []string{"tf1"}},
+		{"Sky Sports Main Event [UHD] 4K", []string{"sky", "sports", "main", "event"}},
+		{"Discovery HEVC 1080p 50fps", []string{"discovery"}},
+		{"Canal+ Foot", []string{"canal+", "foot"}},
+		{"ITV +1", []string{"itv", "+1"}},
+		{"La 1 Catalunya", []string{"la", "1", "catalunya"}},
+		{"Télé Monte-Carlo", []string{"télé", "monte", "carlo"}},
+		{"HD", []string{}},
+		{"", []string{}},
+	}
+
+	for _, test := range tests {
+		got := normalizeChannelName(test.name)
+		if len(got) == 0 && len(test.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNameSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"bbc one", "bbc one", 1},
+		{"bbc 1", "bbc1", 1},
+		{"plain chanel", "plain channel", 11.0 / 12},
+		{"abc", "xyz", 0},
+		{"", "", 0},
+		{"a", "", 0},
+	}
+
+	for _, test := range tests {
+		if got := nameSimilarity(test.a, test.b); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%q %q: %v, want %v", test.a, test.b, got, test.want)
+		}
+		if got, reverse := nameSimilarity(test.a, test.b), nameSimilarity(test.b, test.a); got != reverse {
+			t.Errorf("%q %q: %v one way and %v the other", test.a, test.b, got, reverse)
+		}
+	}
+}
+
+func TestEpgCandidatesBest(t *testing.T) {
+	candidates := newEpgCandidates([]EpgChannel{
+		{EpgID: "bbc1.uk", DisplayNames: []string{"BBC One", "BBC 1"}},
+		{EpgID: "bbc2.uk", DisplayNames: []string{"BBC Two"}},
+		{EpgID: "antena3.es", DisplayNames: []string{"Antena 3"}},
+		{EpgID: "empty", DisplayNames: []string{"HD"}},
+	})
+
+	tests := []struct {
+		name   string
+		epgID  string
+		score  float64
+		scored bool
+	}{
+		{"|UK| BBC One FHD", "bbc1.uk", 1, true},
+		{"BBC1", "bbc1.uk", 1, true},
+		{"ES: Antena 3 HD", "antena3.es", 1, true},
+		{"BBC Tw0", "bbc2.uk", 5.0 / 6, true},
+		{"Completely Other", "", 0, false},
+	}
+
+	for _, test := range tests {
+		best, score := candidates.best(normalizeChannelName(test.name))
+		if !test.scored {
+			if best != nil {
+				t.Errorf("%q: matched %s", test.name, best.channel.EpgID)
+			}
+			continue
+		}
+
+		if best == nil {
+			t.Errorf("%q: no match, want %s", test.name, test.epgID)
+			continue
+		}
+		if best.channel.EpgID != test.epgID || math.Abs(score-test.score) > 1e-9 {
+			t.Errorf("%q: %s scored %v, want %s scored %v", test.name, best.channel.EpgID, score, test.epgID, test.score)
+		}
+	}
+}
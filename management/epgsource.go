@@ -0,0 +1,162 @@
+package management
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+func (s *EpgSource) validate() error {
+	if s.URL == "" {
+		return errors.New("an EPG source needs a URL")
+	}
+	_, err := ParseSchedule(s.RefreshSchedule)
+	return err
+}
+
+func (s *EpgSource) Save() error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+
+	result := DB.Create(s)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	return nil
+}
+
+func (s *EpgSource) Update() error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+
+	result := DB.Model(&EpgSource{}).Where("id = ?", s.ID).UpdateColumns(map[string]interface{}{
+		"Name":            s.Name,
+		"URL":             s.URL,
+		"RefreshSchedule": s.RefreshSchedule,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	return nil
+}
+
+// Delete removes the source, its guide, and gives the channels it fed back
+// the guide of their playlist from the next update.
+func (s *EpgSource) Delete() error {
+	// Not in the middle of an import swapping in the programmes of the source
+	mutexEPG.Lock()
+	defer mutexEPG.Unlock()
+
+	DB.Exec("DELETE FROM programmes WHERE channel_id IN (SELECT id FROM channels WHERE epg_source_id = ?)", s.ID)
+	DB.Exec("UPDATE channels SET epg_source_id = 0 WHERE epg_source_id = ?", s.ID)
+	DB.Exec("DELETE FROM epg_channels WHERE epg_source_id = ?", s.ID)
+	os.Remove(s.filePath())
+
+	result := DB.Delete(s)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	return nil
+}
+
+func (s *EpgSource) filePath() string {
+	return fmt.Sprintf("epg/source-%d.xml", s.ID)
+}
+
+func (s *EpgSource) setStatus(status int, err error) {
+	s.Status = status
+	s.Error = ""
+	if err != nil {
+		s.Error = err.Error()
+	}
+
+	columns := map[string]interface{}{
+		"Status": s.Status,
+		"Error":  s.Error,
+	}
+	if status == 1 {
+		s.LastRefreshAt = time.Now()
+		s.NextRefreshAt = time.Time{}
+		if schedule, err := ParseSchedule(s.RefreshSchedule); err == nil && schedule != nil {
+			s.NextRefreshAt = schedule.Next(s.LastRefreshAt)
+		}
+		columns["LastRefreshAt"] = s.LastRefreshAt
+		columns["NextRefreshAt"] = s.NextRefreshAt
+	}
+
+	if err := DB.Model(&EpgSource{}).Where("id = ?", s.ID).UpdateColumns(columns).Error; err != nil {
+		log.Printf("Failed to save EPG source %d: %v", s.ID, err)
+	}
+}
+
+// Refresh downloads the guide of the source and replaces the programmes of
+// the channels mapped to it.
+func (s *EpgSource) Refresh() error {
+	mutexEPG.Lock()
+	defer mutexEPG.Unlock()
+
+	log.Printf("Processing EPG source: %v [%v]", s.ID, s.Name)
+	s.setStatus(1, nil)
+
+	if err := os.MkdirAll("epg", os.ModePerm); err != nil {
+		s.setStatus(-1, err)
+		return err
+	}
+
+	if err := downloadXMLTV(s.URL, s.filePath()); err != nil {
+		err = fmt.Errorf("failed to download EPG: %w", err)
+		s.setStatus(-1, err)
+		return err
+	}
+
+	if err := (guide{epgSourceID: s.ID}).importFile(s.filePath(), nil); err != nil {
+		s.setStatus(-1, err)
+		return err
+	}
+
+	s.setStatus(2, nil)
+	log.Printf("EPG source %v processed successfully.", s.ID)
+
+	// The new guide may have episodes the series rules want
+	ApplyRecordingRules()
+
+	return nil
+}
+
+func GetEpgSources() ([]EpgSource, error) {
+	var sources []EpgSource
+	result := DB.Find(&sources)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return sources, nil
+}
+
+func GetEpgSourceByID(id uint) (*EpgSource, error) {
+	var source EpgSource
+	result := DB.First(&source, id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &source, nil
+}
+
+// GetEpgChannelsBySourceID lists the channels in the guide of the source.
+func GetEpgChannelsBySourceID(sourceID uint) ([]EpgChannel, error) {
+	var channels []EpgChannel
+	result := DB.Where("epg_source_id = ?", sourceID).Order("epg_id").Find(&channels)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return channels, nil
+}
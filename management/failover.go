@@ -0,0 +1,160 @@
+package management
+
+import (
+	"livestream-companion/stream"
+	"sort"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+// FailoverGroup is a set of channels carrying the same content. Channels with
+// an explicit FailoverGroup form a manual group, the rest are grouped by their
+// EpgChannelID.
+type FailoverGroup struct {
+	Name     string
+	Manual   bool
+	Channels []Channel
+}
+
+func failoverQuery() *gorm.DB {
+	return DB.Preload("Category.Playlist").
+		Joins("JOIN categories on categories.id = channels.category_id").
+		Joins("JOIN playlists on playlists.id = categories.playlist_id").
+		Order("channels.failover_priority ASC, channels.id ASC")
+}
+
+// failoverGroupQuery selects the channels of a group.
+func failoverGroupQuery(name string, manual bool) *gorm.DB {
+	if manual {
+		return failoverQuery().Where("channels.failover_group = ?", name)
+	}
+	return failoverQuery().Where("COALESCE(channels.failover_group, '') = '' AND channels.epg_channel_id = ?", name)
+}
+
+// GetFailoverGroups returns every group with more than one channel.
+func GetFailoverGroups() ([]FailoverGroup, error) {
+	var channels []Channel
+	result := failoverQuery().Where("channels.failover_group <> '' OR channels.epg_channel_id <> ''").Find(&channels)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	groups := make(map[string]*FailoverGroup)
+	for _, channel := range channels {
+		key := "epg:" + channel.EpgChannelID
+		group := FailoverGroup{Name: channel.EpgChannelID}
+		if channel.FailoverGroup != "" {
+			key = "group:" + channel.FailoverGroup
+			group = FailoverGroup{Name: channel.FailoverGroup, Manual: true}
+		}
+
+		if _, ok := groups[key]; !ok {
+			groups[key] = &group
+		}
+		groups[key].Channels = append(groups[key].Channels, channel)
+	}
+
+	failoverGroups := []FailoverGroup{}
+	for _, group := range groups {
+		if len(group.Channels) > 1 {
+			failoverGroups = append(failoverGroups, *group)
+		}
+	}
+	sort.Slice(failoverGroups, func(i, j int) bool {
+		return failoverGroups[i].Name < failoverGroups[j].Name
+	})
+
+	return failoverGroups, nil
+}
+
+// GetFailoverGroup returns the channels of a group in priority order.
+func GetFailoverGroup(name string, manual bool) (*FailoverGroup, error) {
+	var channels []Channel
+	result := failoverGroupQuery(name, manual).Find(&channels)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &FailoverGroup{Name: name, Manual: manual, Channels: channels}, nil
+}
+
+// UpdateFailoverGroup sets the priority of the channels to their position in
+// channelIDs. For manual groups the list also defines the members: listed
+// channels join the group and the others leave it.
+func UpdateFailoverGroup(name string, manual bool, channelIDs []int) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if manual {
+			err := tx.Model(&Channel{}).Where("failover_group = ?", name).UpdateColumns(map[string]interface{}{
+				"FailoverGroup":    "",
+				"FailoverPriority": 0,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		for priority, id := range channelIDs {
+			columns := map[string]interface{}{"FailoverPriority": priority}
+			if manual {
+				columns["FailoverGroup"] = name
+			}
+			if err := tx.Model(&Channel{}).Where("id = ?", id).UpdateColumns(columns).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// GetFailoverSources returns the other channels of the channel's group that can
+// replace it, in priority order, skipping expired playlists and disabled channels.
+func GetFailoverSources(channel *Channel) ([]stream.Source, error) {
+	var query *gorm.DB
+	if channel.FailoverGroup != "" {
+		query = failoverGroupQuery(channel.FailoverGroup, true)
+	} else if channel.EpgChannelID != "" {
+		query = failoverGroupQuery(channel.EpgChannelID, false)
+	} else {
+		return nil, nil
+	}
+
+	var candidates []Channel
+	if err := query.Where("channels.active = ? AND categories.active = ?", true, true).Find(&candidates).Error; err != nil {
+		return nil, err
+	}
+
+	sources := []stream.Source{}
+	for _, candidate := range candidates {
+		if candidate.ID == channel.ID || candidate.Category.Playlist.Expired {
+			continue
+		}
+		sources = append(sources, channelSource(&candidate))
+	}
+
+	return sources, nil
+}
+
+// channelSource describes where to stream the channel from. The channel must
+// have its Category.Playlist loaded.
+func channelSource(channel *Channel) stream.Source {
+	playlist := channel.Category.Playlist
+	return stream.Source{
+		ChannelID:      strconv.Itoa(channel.ID),
+		PlaylistID:     playlist.ID,
+		MaxConnections: playlist.MaxConnections,
+		PreemptOldest:  playlist.PreemptOldest,
+		InputURL:       channel.StreamURL,
+	}
+}
+
+// usePassthrough relays the upstream as is when the playlist of the channel
+// asks for it, unless a profile was picked. The channel must have its
+// Category.Playlist loaded.
+func usePassthrough(tune *stream.Tune, channel *Channel, profileName string) {
+	if channel.Category.Playlist.Passthrough && profileName == "" {
+		tune.Profile = stream.PassthroughProfile
+		tune.Passthrough = true
+	}
+}
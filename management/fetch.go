@@ -0,0 +1,46 @@
+package management
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// openLocation opens an http(s) URL, a file:// URL or a local path.
+func openLocation(location string) (io.ReadCloser, error) {
+	if strings.HasPrefix(location, "file://") {
+		return os.Open(strings.TrimPrefix(location, "file://"))
+	}
+	if !strings.Contains(location, "://") {
+		return os.Open(location)
+	}
+
+	resp, err := http.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+// gunzipped decompresses gzip content on the fly, recognized from its header
+// whatever the file name or Content-Encoding. Other content is read as is.
+func gunzipped(r io.Reader) (io.Reader, error) {
+	reader := bufio.NewReader(r)
+	if magic, err := reader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return gz, nil
+	}
+	return reader, nil
+}
@@ -0,0 +1,160 @@
+package management
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// guide is where channels take their programmes from: the XMLTV of their
+// playlist, or the EPG source they were mapped to.
+type guide struct {
+	playlistID  uint
+	epgSourceID uint
+}
+
+// filePath is where the guide was last downloaded.
+func (g guide) filePath() string {
+	if g.epgSourceID != 0 {
+		return (&EpgSource{ID: g.epgSourceID}).filePath()
+	}
+	return fmt.Sprintf("epg/%v.xml", g.playlistID)
+}
+
+// channelScope is the condition on channels selecting those fed by the guide.
+func (g guide) channelScope() (string, uint) {
+	if g.epgSourceID != 0 {
+		return "channels.epg_source_id = ?", g.epgSourceID
+	}
+	return "COALESCE(channels.epg_source_id, 0) = 0 AND channels.category_id IN (SELECT id FROM categories WHERE playlist_id = ?)", g.playlistID
+}
+
+// channelIDsByEpgID returns the IDs of the channels fed by the guide by EPG
+// ID, in a single query.
+func (g guide) channelIDsByEpgID() (map[string][]int, error) {
+	scope, id := g.channelScope()
+
+	var channels []Channel
+	result := DB.Select("channels.id, channels.epg_channel_id").
+		Where("channels.epg_channel_id <> ''").
+		Where(scope, id).
+		Find(&channels)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	channelIDs := make(map[string][]int)
+	for _, channel := range channels {
+		channelIDs[channel.EpgChannelID] = append(channelIDs[channel.EpgChannelID], channel.ID)
+	}
+
+	return channelIDs, nil
+}
+
+// importFile replaces the programmes of the channels fed by the guide, and
+// the XMLTV channels it lists, with the content of an XMLTV file. The new
+// programmes are written as they are parsed, hidden as soft deleted so the
+// database stays writable meanwhile, then swapped for the old ones in one
+// short transaction. The old guide stays if anything fails.
+func (g guide) importFile(path string, job *ImportJob) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open EPG file: %w", err)
+	}
+	defer file.Close()
+
+	channelIDsByEpgID, err := g.channelIDsByEpgID()
+	if err != nil {
+		return fmt.Errorf("failed to get channels: %w", err)
+	}
+
+	// Only guide imports write programmes and they run one at a time, so the
+	// new ones are those after the last ID. Leftovers of an interrupted import
+	// go first.
+	if err := DB.Exec("DELETE FROM programmes WHERE deleted_at IS NOT NULL").Error; err != nil {
+		return fmt.Errorf("failed to delete programmes from DB: %w", err)
+	}
+	var lastID uint
+	if err := DB.Raw("SELECT COALESCE(MAX(id), 0) FROM programmes").Scan(&lastID).Error; err != nil {
+		return fmt.Errorf("failed to get programmes: %w", err)
+	}
+	staged := gorm.DeletedAt{Time: time.Now(), Valid: true}
+
+	// Whatever fails from here, the staged programmes must not be left behind
+	swapped := false
+	defer func() {
+		if !swapped {
+			discardStagedProgrammes(lastID)
+		}
+	}()
+
+	var newChannels []EpgChannel
+	var newProgrammes []Programme
+	err = ParseXMLTV(file, func(epgChannel *EPGChannel) error {
+		newChannels = append(newChannels, EpgChannel{
+			PlaylistID:   g.playlistID,
+			EpgSourceID:  g.epgSourceID,
+			EpgID:        epgChannel.ID,
+			DisplayNames: epgChannel.DisplayNames,
+			Icon:         epgChannel.Icon.Src,
+		})
+		return nil
+	}, func(epgProgramme *EPGProgramme) error {
+		job.update(func(job *ImportJob) { job.Processed++ })
+
+		for _, channelID := range channelIDsByEpgID[epgProgramme.Channel] {
+			programme := epgProgramme.programme(channelID)
+			programme.DeletedAt = staged
+			newProgrammes = append(newProgrammes, programme)
+		}
+
+		if len(newProgrammes) < programmeBatchSize {
+			return nil
+		}
+		if err := insertProgrammes(DB, newProgrammes, job); err != nil {
+			return err
+		}
+		newProgrammes = newProgrammes[:0]
+		return nil
+	})
+	if err == nil {
+		err = insertProgrammes(DB, newProgrammes, job)
+	} else {
+		err = fmt.Errorf("failed to parse XMLTV data: %w", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		scope, id := g.channelScope()
+		if err := tx.Exec("DELETE FROM programmes WHERE id <= ? AND channel_id IN (SELECT id FROM channels WHERE "+scope+")", lastID, id).Error; err != nil {
+			return fmt.Errorf("failed to delete programmes from DB: %w", err)
+		}
+		if err := tx.Exec("UPDATE programmes SET deleted_at = NULL WHERE id > ?", lastID).Error; err != nil {
+			return fmt.Errorf("failed to save programmes: %w", err)
+		}
+
+		if err := tx.Where("playlist_id = ? AND epg_source_id = ?", g.playlistID, g.epgSourceID).Delete(&EpgChannel{}).Error; err != nil {
+			return fmt.Errorf("failed to delete EPG channels from DB: %w", err)
+		}
+		if len(newChannels) > 0 {
+			if err := tx.CreateInBatches(&newChannels, programmeBatchSize).Error; err != nil {
+				return fmt.Errorf("failed to save EPG channels: %w", err)
+			}
+		}
+		return nil
+	})
+	swapped = err == nil
+	return err
+}
+
+// discardStagedProgrammes deletes the programmes an import staged after lastID.
+func discardStagedProgrammes(lastID uint) {
+	if err := DB.Exec("DELETE FROM programmes WHERE id > ? AND deleted_at IS NOT NULL", lastID).Error; err != nil {
+		log.Printf("Failed to delete staged programmes: %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package management
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeGuide writes an XMLTV file with count programmes on one.x, cut short
+// when truncated.
+func writeGuide(t *testing.T, title string, count int, truncated bool) string {
+	t.Helper()
+
+	var guide strings.Builder
+	guide.WriteString(`<?xml version="1.0" encoding="UTF-8"?><tv><channel id="one.x"><display-name>One</display-name></channel>`)
+	for i := 0; i < count; i++ {
+		fmt.Fprintf(&guide, `<programme start="20261018%02d%02d00 +0000" stop="20261018%02d%02d59 +0000" channel="one.x"><title>%s %d</title></programme>`,
+			i/60%24, i%60, i/60%24, i%60, title, i)
+	}
+	if truncated {
+		guide.WriteString(`<programme start="broken`)
+	} else {
+		guide.WriteString(`</tv>`)
+	}
+
+	path := filepath.Join(t.TempDir(), "guide.xml")
+	if err := os.WriteFile(path, []byte(guide.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGuideImportKeepsOldProgrammesOnFailure(t *testing.T) {
+	openTestDB(t)
+
+	category := Category{PlaylistID: 1, CategoryName: "News", Active: true}
+	if err := DB.Create(&category).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := DB.Create(&Channel{ID: 1, Name: "One", CategoryID: category.ID, EpgChannelID: "one.x", Active: true}).Error; err != nil {
+		t.Fatal(err)
+	}
+	g := guide{playlistID: 1}
+
+	titles := func() map[string]int {
+		var programmes []Programme
+		if err := DB.Unscoped().Find(&programmes).Error; err != nil {
+			t.Fatal(err)
+		}
+		counts := make(map[string]int)
+		for _, programme := range programmes {
+			if programme.DeletedAt.Valid {
+				counts["staged"]++
+			} else {
+				counts[strings.Fields(programme.Title)[0]]++
+			}
+		}
+		return counts
+	}
+
+	if err := g.importFile(writeGuide(t, "Old", 3, false), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := titles(); got["Old"] != 3 || len(got) != 1 {
+		t.Fatalf("after the first import: %v", got)
+	}
+
+	// More than a batch, so some programmes are staged before the error
+	if err := g.importFile(writeGuide(t, "New", programmeBatchSize+10, true), nil); err == nil {
+		t.Fatal("truncated guide imported")
+	}
+	if got := titles(); got["Old"] != 3 || len(got) != 1 {
+		t.Errorf("after a failed import: %v, want the old guide alone", got)
+	}
+
+	if err := g.importFile(writeGuide(t, "New", 5, false), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := titles(); got["New"] != 5 || len(got) != 1 {
+		t.Errorf("after the second import: %v, want the new guide alone", got)
+	}
+}
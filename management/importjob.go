@@ -0,0 +1,160 @@
+package management
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Phases of a playlist import
+const (
+	ImportPhaseCategories = "categories"
+	ImportPhaseChannels   = "channels"
+	ImportPhaseVod        = "vod"
+	ImportPhaseEpg        = "epg"
+)
+
+// Status of an import job. A partial import went through with a phase
+// failing, like the VOD.
+const (
+	ImportRunning = "running"
+	ImportDone    = "done"
+	ImportPartial = "partial"
+	ImportFailed  = "failed"
+)
+
+// Import jobs in progress by playlist ID, for the live progress endpoint.
+// Jobs are only changed through update while they are in there.
+var importJobs = make(map[uint]*ImportJob)
+var mutexImportJobs = &sync.Mutex{}
+
+// startImportJob records the beginning of an import of the playlist.
+func startImportJob(playlistID uint) *ImportJob {
+	job := &ImportJob{
+		PlaylistID: playlistID,
+		StartedAt:  time.Now(),
+		Status:     ImportRunning,
+	}
+	if err := DB.Create(job).Error; err != nil {
+		log.Printf("Failed to save the import job of playlist %d: %v", playlistID, err)
+	}
+
+	mutexImportJobs.Lock()
+	importJobs[playlistID] = job
+	mutexImportJobs.Unlock()
+
+	return job
+}
+
+// update changes the job while nobody reads it. A nil job is ignored, as for
+// EPG updates that are not part of an import.
+func (j *ImportJob) update(change func(job *ImportJob)) {
+	if j == nil {
+		return
+	}
+
+	mutexImportJobs.Lock()
+	change(j)
+	mutexImportJobs.Unlock()
+}
+
+// setPhase starts a phase of total items and saves the progress so far.
+func (j *ImportJob) setPhase(phase string, total int) {
+	if j == nil {
+		return
+	}
+
+	j.update(func(job *ImportJob) {
+		job.Phase = phase
+		job.Total = total
+		job.Processed = 0
+	})
+	j.save()
+}
+
+// phaseFailed records the error of a phase the import goes on after.
+func (j *ImportJob) phaseFailed(phase string, err error) {
+	j.update(func(job *ImportJob) { job.addError(phase + ": " + err.Error()) })
+}
+
+func (j *ImportJob) addError(message string) {
+	if j.Error != "" {
+		j.Error += "; "
+	}
+	j.Error += message
+}
+
+func (j *ImportJob) finish(err error) {
+	if j == nil {
+		return
+	}
+
+	j.update(func(job *ImportJob) {
+		job.FinishedAt = time.Now()
+		switch {
+		case err != nil:
+			job.Status = ImportFailed
+			job.addError(err.Error())
+		case job.Error != "":
+			job.Status = ImportPartial
+		default:
+			job.Status = ImportDone
+		}
+	})
+	j.save()
+
+	mutexImportJobs.Lock()
+	if importJobs[j.PlaylistID] == j {
+		delete(importJobs, j.PlaylistID)
+	}
+	mutexImportJobs.Unlock()
+}
+
+func (j *ImportJob) save() {
+	mutexImportJobs.Lock()
+	job := *j
+	mutexImportJobs.Unlock()
+
+	if err := DB.Save(&job).Error; err != nil {
+		log.Printf("Failed to save import job %d: %v", job.ID, err)
+	}
+}
+
+// GetImportJobsByPlaylistID returns the last imports of the playlist, the
+// most recent first.
+func GetImportJobsByPlaylistID(playlistID uint) ([]ImportJob, error) {
+	var jobs []ImportJob
+	result := DB.Where("playlist_id = ?", playlistID).Order("started_at desc").Limit(50).Find(&jobs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return jobs, nil
+}
+
+// GetImportProgress returns the running import of the playlist, or its last
+// import when none is running, nil if it was never imported.
+func GetImportProgress(playlistID uint) (*ImportJob, error) {
+	mutexImportJobs.Lock()
+	running, ok := importJobs[playlistID]
+	var job ImportJob
+	if ok {
+		job = *running
+	}
+	mutexImportJobs.Unlock()
+
+	if ok {
+		return &job, nil
+	}
+
+	var jobs []ImportJob
+	result := DB.Where("playlist_id = ?", playlistID).Order("started_at desc").Limit(1).Find(&jobs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(jobs) == 0 {
+		return nil, nil
+	}
+
+	return &jobs[0], nil
+}
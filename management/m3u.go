@@ -2,148 +2,158 @@ package management
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"log"
-	"net/http"
-	"regexp"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
-
-	"github.com/gin-gonic/gin"
+	"unicode/utf8"
 )
 
-type M3UCategory struct {
-	CategoryID   string `json:"category_id"`
-	CategoryName string `json:"category_name"`
-	ParentID     int    `json:"parent_id"`
-}
+// Group of the entries that don't have one
+const m3uDefaultGroup = "Uncategorized"
+
+// Directory keeping the last imported copy of each m3u playlist
+const m3uDir = "m3u"
 
-type M3uChannel struct {
-	Num               int      `json:"num"`
-	Name              string   `json:"name"`
-	StreamType        string   `json:"stream_type"`
-	StreamID          int      `json:"stream_id"`
-	StreamIcon        string   `json:"stream_icon"`
-	EpgChannelID      string   `json:"epg_channel_id"`
-	Added             string   `json:"added"`
-	CustomSid         string   `json:"custom_sid"`
-	TvArchive         int      `json:"tv_archive"`
-	DirectSource      string   `json:"direct_source"`
-	TvArchiveDuration int      `json:"tv_archive_duration"`
-	CategoryID        string   `json:"category_id"`
-	CategoryIds       []string `json:"category_ids"`
-	Thumbnail         string   `json:"thumbnail"`
-	StreamURL         string   `json:"stream_url"`
+func m3uFilePath(playlistID uint) string {
+	return filepath.Join(m3uDir, fmt.Sprintf("%d.m3u", playlistID))
 }
 
-func getM3uData(url string) (*bufio.Scanner, error) {
-	resp, err := http.Get(url)
+// StoreM3u validates a playlist, gzip compressed or not, and keeps it as the
+// copy imported for the playlist. Returns the number of entries.
+func StoreM3u(playlistID uint, r io.Reader) (int, error) {
+	content, err := gunzipped(r)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	scanner := bufio.NewScanner(resp.Body)
-	return scanner, nil
-}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return 0, err
+	}
 
-func M3uCategoryHandler(c *gin.Context) {
-	playlistIDStr := c.Param("playlistID") // This gets the playlistID from the URL
+	if !bytes.Contains(data, []byte("#EXTINF")) {
+		return 0, errors.New("not an m3u playlist, no #EXTINF line found")
+	}
 
-	playlistIDUint64, err := strconv.ParseUint(playlistIDStr, 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid playlist ID"})
-		log.Print(err)
-		return
+	// Older playlists are often in latin-1 or Windows-1252
+	if !utf8.Valid(data) {
+		data, err = io.ReadAll(&latin1Reader{r: bufio.NewReader(bytes.NewReader(data))})
+		if err != nil {
+			return 0, err
+		}
 	}
-	playlistID := uint(playlistIDUint64)
 
-	playlist, err := GetPlaylistByID(playlistID)
+	entries, err := ParseM3u(bytes.NewReader(data))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get playlist by ID"})
-		log.Print(err)
-		return
+		return 0, err
+	}
+	if len(entries) == 0 {
+		return 0, errors.New("no streams found in the playlist")
 	}
 
-	categories := make(map[string]string)
-	scanner, err := getM3uData(playlist.M3uURL)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data from M3U URL"})
-		return
+	if err := os.MkdirAll(m3uDir, os.ModePerm); err != nil {
+		return 0, err
 	}
 
-	categoryRegexp := regexp.MustCompile(`group-title="(.*?)"`)
+	// Write then rename, so a failed import never leaves a truncated copy
+	tmpPath := m3uFilePath(playlistID) + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmpPath, m3uFilePath(playlistID)); err != nil {
+		return 0, err
+	}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		matches := categoryRegexp.FindStringSubmatch(line)
+	return len(entries), nil
+}
 
-		if len(matches) > 1 {
-			category := matches[1]
-			if _, ok := categories[category]; !ok {
-				id := strings.ReplaceAll(category, " ", "_")
-				categories[category] = id
-			}
-		}
+// RefreshM3u downloads the playlist from its M3uURL and stores it.
+func RefreshM3u(playlist *Playlist) error {
+	if playlist.M3uURL == "" {
+		return nil
 	}
 
-	result := []M3UCategory{}
-	for k, v := range categories {
-		result = append(result, M3UCategory{CategoryID: v, CategoryName: k, ParentID: 0})
+	r, err := openLocation(playlist.M3uURL)
+	if err != nil {
+		return err
 	}
+	defer r.Close()
 
-	c.JSON(http.StatusOK, result)
+	_, err = StoreM3u(playlist.ID, r)
+	return err
 }
 
-func M3uChannelHandler(c *gin.Context) {
-	playlistIDStr := c.Param("playlistID")
+// getM3uEntries reads the stored copy of the playlist, refreshed from its
+// M3uURL when there is one. The stored copy is used when the source can't be
+// reached, and is the only source of uploaded playlists.
+func getM3uEntries(playlist *Playlist) ([]M3uEntry, error) {
+	refreshErr := RefreshM3u(playlist)
 
-	playlistIDUint64, err := strconv.ParseUint(playlistIDStr, 10, 32)
+	file, err := os.Open(m3uFilePath(playlist.ID))
+	if os.IsNotExist(err) {
+		if refreshErr != nil {
+			return nil, fmt.Errorf("failed to get the m3u of the playlist: %w", refreshErr)
+		}
+		return nil, errors.New("no m3u was uploaded for the playlist")
+	}
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid playlist ID"})
-		log.Print(err)
-		return
+		return nil, err
 	}
-	playlistID := uint(playlistIDUint64)
+	defer file.Close()
 
-	playlist, err := GetPlaylistByID(playlistID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get playlist by ID"})
-		log.Print(err)
-		return
+	if refreshErr != nil {
+		log.Printf("Could not refresh the m3u of playlist %d, using the stored copy: %v", playlist.ID, refreshErr)
 	}
 
-	channels := make([]M3uChannel, 0)
-	scanner, err := getM3uData(playlist.M3uURL)
+	return ParseM3u(file)
+}
+
+func m3uGroup(entry *M3uEntry) string {
+	if entry.Group == "" {
+		return m3uDefaultGroup
+	}
+	return entry.Group
+}
+
+func m3uCategoryID(group string) string {
+	return strings.ReplaceAll(group, " ", "_")
+}
+
+// m3uChannel converts a playlist entry to a channel, as the Xtream API would
+// describe it.
+func m3uChannel(entry *M3uEntry, index int) Channel {
+	group := m3uGroup(entry)
+
+	num := index
+	if chno, err := strconv.Atoi(entry.Attribute("tvg-chno")); err == nil {
+		num = chno
+	}
+
+	// catchup="default" catchup-days="7", or the older timeshift="7"
+	archive := 0
+	archiveDays, err := strconv.Atoi(entry.Attribute("catchup-days"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data from M3U URL"})
-		return
-	}
-
-	channelRegexp := regexp.MustCompile(`#EXTINF:-1 tvg-name="(.*?)" tvg-logo="(.*?)" group-title="(.*?)"`)
-
-	var streamURL string
-	for scanner.Scan() {
-		line := scanner.Text()
-		channelMatches := channelRegexp.FindStringSubmatch(line)
-
-		if len(channelMatches) > 1 {
-			streamURL = ""
-			if scanner.Scan() {
-				streamURL = scanner.Text()
-			}
-			channels = append(channels, M3uChannel{
-				Num:        len(channels) + 1,
-				Name:       channelMatches[1],
-				StreamType: "live",
-				StreamID:   len(channels) + 1,
-				StreamIcon: channelMatches[2],
-				CategoryID: strings.ReplaceAll(channelMatches[3], " ", "_"),
-				CategoryIds: []string{
-					channelMatches[3],
-				},
-				StreamURL: streamURL,
-			})
-		}
+		archiveDays, _ = strconv.Atoi(entry.Attribute("timeshift"))
+	}
+	if entry.Attribute("catchup") != "" || archiveDays > 0 {
+		archive = 1
 	}
 
-	c.JSON(http.StatusOK, channels)
+	return Channel{
+		Num:                num,
+		Name:               entry.Name,
+		StreamID:           index,
+		StreamIcon:         entry.Attribute("tvg-logo"),
+		EpgChannelID:       entry.Attribute("tvg-id"),
+		TvArchive:          FlexInt(archive),
+		TvArchiveDuration:  FlexInt(archiveDays),
+		ExternalCategoryID: m3uCategoryID(group),
+		StreamURL:          entry.URL,
+	}
 }
@@ -0,0 +1,158 @@
+package management
+
+import (
+	"bufio"
+	"io"
+	"path"
+	"strings"
+)
+
+// M3uEntry is one stream of an M3U or M3U+ playlist.
+type M3uEntry struct {
+	Duration   string
+	Name       string            // Display name, after the comma of #EXTINF
+	Attributes map[string]string // tvg-id, tvg-name, tvg-logo, group-title, tvg-chno, catchup...
+	Group      string            // group-title, or #EXTGRP when there is none
+	VLCOptions map[string]string // #EXTVLCOPT, like http-user-agent
+	KodiProps  map[string]string // #KODIPROP, like inputstream.adaptive.license_type
+	URL        string
+}
+
+// Attribute returns the value of an #EXTINF attribute, empty if missing.
+func (e *M3uEntry) Attribute(name string) string {
+	return e.Attributes[name]
+}
+
+// ParseM3u reads every entry of a playlist. Attributes can come in any order
+// and quoted or not, the tags of an entry are those between its #EXTINF and
+// its URL. URLs without #EXTINF are kept, named after the file.
+func ParseM3u(r io.Reader) ([]M3uEntry, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var entries []M3uEntry
+	entry := newM3uEntry()
+	extgrp := ""
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "":
+			continue
+
+		case strings.HasPrefix(line, "#EXTINF:"):
+			entry = newM3uEntry()
+			parseExtinf(&entry, strings.TrimPrefix(line, "#EXTINF:"))
+
+		case strings.HasPrefix(line, "#EXTGRP:"):
+			extgrp = strings.TrimSpace(strings.TrimPrefix(line, "#EXTGRP:"))
+
+		case strings.HasPrefix(line, "#EXTVLCOPT:"):
+			key, value := splitOption(strings.TrimPrefix(line, "#EXTVLCOPT:"))
+			entry.VLCOptions[key] = value
+
+		case strings.HasPrefix(line, "#KODIPROP:"):
+			key, value := splitOption(strings.TrimPrefix(line, "#KODIPROP:"))
+			entry.KodiProps[key] = value
+
+		case strings.HasPrefix(line, "#"):
+			// #EXTM3U and anything else we don't use
+
+		default:
+			entry.URL = line
+			entry.Group = entry.Attribute("group-title")
+			if entry.Group == "" {
+				entry.Group = extgrp
+			}
+			if entry.Name == "" {
+				entry.Name = entry.Attribute("tvg-name")
+			}
+			if entry.Name == "" {
+				entry.Name = strings.TrimSuffix(path.Base(line), path.Ext(line))
+			}
+
+			entries = append(entries, entry)
+			entry = newM3uEntry()
+			extgrp = ""
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+func newM3uEntry() M3uEntry {
+	return M3uEntry{
+		Attributes: make(map[string]string),
+		VLCOptions: make(map[string]string),
+		KodiProps:  make(map[string]string),
+	}
+}
+
+func splitOption(option string) (string, string) {
+	key, value, _ := strings.Cut(option, "=")
+	return strings.TrimSpace(key), strings.TrimSpace(value)
+}
+
+// parseExtinf reads `<duration> key="value" key2=value2 ...,<display name>`.
+// The display name starts at the first comma outside of a quoted value.
+func parseExtinf(entry *M3uEntry, line string) {
+	i := 0
+	for i < len(line) && line[i] != ' ' && line[i] != '\t' && line[i] != ',' {
+		i++
+	}
+	entry.Duration = line[:i]
+
+	for i < len(line) {
+		switch line[i] {
+		case ' ', '\t':
+			i++
+			continue
+		case ',':
+			entry.Name = strings.TrimSpace(line[i+1:])
+			return
+		}
+
+		start := i
+		for i < len(line) && line[i] != '=' && line[i] != ' ' && line[i] != '\t' && line[i] != ',' {
+			i++
+		}
+		key := strings.ToLower(line[start:i])
+
+		if i >= len(line) || line[i] != '=' {
+			// A flag without value
+			if key != "" {
+				entry.Attributes[key] = ""
+			}
+			continue
+		}
+		i++
+
+		var value string
+		if i < len(line) && (line[i] == '"' || line[i] == '\'') {
+			quote := line[i]
+			i++
+			end := strings.IndexByte(line[i:], quote)
+			if end < 0 {
+				// Unterminated quote, take the rest up to the display name
+				end = strings.IndexByte(line[i:], ',')
+				if end < 0 {
+					end = len(line) - i
+				}
+				value = line[i : i+end]
+				i += end
+			} else {
+				value = line[i : i+end]
+				i += end + 1
+			}
+		} else {
+			start := i
+			for i < len(line) && line[i] != ' ' && line[i] != '\t' && line[i] != ',' {
+				i++
+			}
+			value = line[start:i]
+		}
+
+		entry.Attributes[key] = value
+	}
+}
@@ -0,0 +1,152 @@
+package management
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseExtinf(t *testing.T) {
+	tests := []struct {
+		line       string
+		duration   string
+		name       string
+		attributes map[string]string
+	}{
+		{
+			line:       `-1,Plain Channel`,
+			duration:   "-1",
+			name:       "Plain Channel",
+			attributes: map[string]string{},
+		},
+		{
+			line:     `-1 tvg-id="one.es" tvg-name="La 1" group-title="Spain",La 1 HD`,
+			duration: "-1",
+			name:     "La 1 HD",
+			attributes: map[string]string{
+				"tvg-id":      "one.es",
+				"tvg-name":    "La 1",
+				"group-title": "Spain",
+			},
+		},
+		{
+			line:     `-1 group-title="News, Sports" tvg-logo="http://logo/a,b.png",Name, with comma`,
+			duration: "-1",
+			name:     "Name, with comma",
+			attributes: map[string]string{
+				"group-title": "News, Sports",
+				"tvg-logo":    "http://logo/a,b.png",
+			},
+		},
+		{
+			line:     `0 tvg-chno=7 TVG-ID='single.quoted' catchup-days=3,Unquoted`,
+			duration: "0",
+			name:     "Unquoted",
+			attributes: map[string]string{
+				"tvg-chno":     "7",
+				"tvg-id":       "single.quoted",
+				"catchup-days": "3",
+			},
+		},
+		{
+			line:     `-1 radio tvg-id="",Flag and empty value`,
+			duration: "-1",
+			name:     "Flag and empty value",
+			attributes: map[string]string{
+				"radio":  "",
+				"tvg-id": "",
+			},
+		},
+		{
+			line:     `-1 tvg-name="Unterminated,Name after it`,
+			duration: "-1",
+			name:     "Name after it",
+			attributes: map[string]string{
+				"tvg-name": "Unterminated",
+			},
+		},
+		{
+			line:     `-1	tvg-id="tab.separated"	group-title="Tabs",Tabs`,
+			duration: "-1",
+			name:     "Tabs",
+			attributes: map[string]string{
+				"tvg-id":      "tab.separated",
+				"group-title": "Tabs",
+			},
+		},
+		{
+			line:       `-1`,
+			duration:   "-1",
+			name:       "",
+			attributes: map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		entry := newM3uEntry()
+		parseExtinf(&entry, test.line)
+
+		if entry.Duration != test.duration {
+			t.Errorf("%s: duration %q, want %q", test.line, entry.Duration, test.duration)
+		}
+		if entry.Name != test.name {
+			t.Errorf("%s: name %q, want %q", test.line, entry.Name, test.name)
+		}
+		if !reflect.DeepEqual(entry.Attributes, test.attributes) {
+			t.Errorf("%s: attributes %v, want %v", test.line, entry.Attributes, test.attributes)
+		}
+	}
+}
+
+func TestParseM3u(t *testing.T) {
+	playlist := `#EXTM3U x-tvg-url="http://guide"
+
+#EXTINF:-1 tvg-id="a.x" group-title="Group A",Channel A
+#EXTVLCOPT:http-user-agent=Player/1.0
+#KODIPROP:inputstream.adaptive.license_type=clearkey
+http://host/a.ts
+#EXTINF:-1 tvg-name="Named B",
+#EXTGRP:Group B
+http://host/b.m3u8
+#EXTINF:-1 tvg-id="c.x",
+#EXTGRP:Ignored
+#EXTINF:-1 group-title="Group C",Channel C
+http://host/c.ts
+http://host/path/bare-stream.ts
+`
+
+	entries, err := ParseM3u(strings.NewReader(playlist))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		name, group, url string
+	}{
+		{"Channel A", "Group A", "http://host/a.ts"},
+		{"Named B", "Group B", "http://host/b.m3u8"},
+		{"Channel C", "Group C", "http://host/c.ts"},
+		{"bare-stream", "", "http://host/path/bare-stream.ts"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("%d entries, want %d", len(entries), len(want))
+	}
+	for i, w := range want {
+		if entries[i].Name != w.name || entries[i].Group != w.group || entries[i].URL != w.url {
+			t.Errorf("entry %d: %q %q %q, want %q %q %q", i, entries[i].Name, entries[i].Group, entries[i].URL, w.name, w.group, w.url)
+		}
+	}
+
+	if got := entries[0].VLCOptions["http-user-agent"]; got != "Player/1.0" {
+		t.Errorf("user agent %q, want Player/1.0", got)
+	}
+	if got := entries[0].KodiProps["inputstream.adaptive.license_type"]; got != "clearkey" {
+		t.Errorf("license type %q, want clearkey", got)
+	}
+	if got := entries[2].Attribute("tvg-id"); got != "" {
+		t.Errorf("a second #EXTINF kept tvg-id %q of the first", got)
+	}
+	if len(entries[3].VLCOptions) != 0 {
+		t.Errorf("options leaked to the next entry: %v", entries[3].VLCOptions)
+	}
+}
@@ -29,7 +29,14 @@ type Playlist struct {
 	ImportStatus       int `gorm:"default:0"`
 	EpgStatus          int `gorm:"default:0"`
 	Restream           bool
+	Passthrough        bool
 	Expired            bool
+	MaxConnections     int
+	PreemptOldest      bool
+	TranscodeProfileID uint
+	RefreshSchedule    string // Interval like 6h or cron expression, empty to only refresh by hand
+	LastRefreshAt      time.Time
+	NextRefreshAt      time.Time
 	Categories         []Category `gorm:"foreignKey:PlaylistID;references:ID"`
 }
 
@@ -59,8 +66,15 @@ type Channel struct {
 	StreamURL          string   `gorm:"streamurl" json:"stream_url"`
 	EpgChannelID       string   `json:"epg_channel_id"`
 	HDHRChannelNum     int
-	StreamIcon         string `json:"stream_icon"`
+	StreamIcon         string  `json:"stream_icon"`
+	TvArchive          FlexInt `json:"tv_archive"`
+	TvArchiveDuration  FlexInt `json:"tv_archive_duration"` // Days
 	Active             bool
+	TranscodeProfileID uint
+	FailoverGroup      string `gorm:"index"`
+	FailoverPriority   int
+	EpgSourceID        uint        `gorm:"index"` // Guide from an EPG source instead of the playlist
+	CustomEpg          bool        // EPG mapping set by hand, kept by imports
 	Programmes         []Programme `gorm:"foreignKey:ChannelID"`
 }
 
@@ -74,6 +88,170 @@ type Programme struct {
 	ChannelID      int    // ForeignKey referencing EpgChannel
 	Title          string `gorm:"type:varchar(255)" xml:"title"`
 	Desc           string `gorm:"type:text" xml:"desc"`
+	EpisodeNum     string `gorm:"type:varchar(255)" xml:"episode-num"` // Onscreen, like S01E05
+
+	// XMLTV metadata players use for series detection and artwork
+	SubTitle             string   `gorm:"type:varchar(255)"`
+	Categories           []string `gorm:"serializer:json"`
+	EpisodeNumXmltv      string   `gorm:"type:varchar(255)"` // xmltv_ns, like 0.4.
+	Icon                 string
+	Rating               string
+	RatingSystem         string
+	Credits              XMLTVCredits `gorm:"serializer:json"`
+	Date                 string
+	PreviouslyShown      bool
+	PreviouslyShownStart string
+	New                  bool
+	Language             string
+}
+
+type VodCategory struct {
+	ID           uint `gorm:"primaryKey"`
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	Kind         string `gorm:"index"` // "movie" or "series"
+	Num          int
+	ExternalID   string `gorm:"index" json:"category_id"`
+	CategoryName string `json:"category_name"`
+	PlaylistID   uint   `gorm:"index"`
+	Active       bool
+}
+
+type Movie struct {
+	ID                 uint `gorm:"primaryKey"`
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
+	Num                int
+	Name               string  `json:"name"`
+	PlaylistID         uint    `gorm:"index"`
+	VodCategoryID      uint    `gorm:"index"`
+	ExternalCategoryID string  `json:"category_id"`
+	StreamID           FlexInt `gorm:"index" json:"stream_id"`
+	StreamIcon         string  `json:"stream_icon"`
+	Added              string  `json:"added"`
+	ContainerExtension string  `json:"container_extension"`
+	StreamURL          string
+}
+
+type Series struct {
+	ID                 uint `gorm:"primaryKey"`
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
+	Num                int
+	Name               string  `json:"name"`
+	PlaylistID         uint    `gorm:"index"`
+	VodCategoryID      uint    `gorm:"index"`
+	ExternalCategoryID string  `json:"category_id"`
+	SeriesID           FlexInt `gorm:"index" json:"series_id"`
+	Cover              string  `json:"cover"`
+	Plot               string  `json:"plot"`
+	Genre              string  `json:"genre"`
+	ReleaseDate        string  `json:"releaseDate"`
+	EpisodesUpdatedAt  time.Time
+	Episodes           []Episode `gorm:"foreignKey:SeriesID;references:ID"`
+}
+
+type Episode struct {
+	ID                 uint `gorm:"primaryKey"`
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
+	SeriesID           uint    `gorm:"index"`
+	ExternalID         string  `json:"id"`
+	Title              string  `json:"title"`
+	Season             FlexInt `json:"season"`
+	EpisodeNum         FlexInt `json:"episode_num"`
+	ContainerExtension string  `json:"container_extension"`
+	StreamURL          string
+}
+
+type TranscodeProfile struct {
+	ID          uint `gorm:"primaryKey"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Name        string `gorm:"uniqueIndex"`
+	VideoCodec  string
+	AudioCodec  string
+	Resolution  string
+	Bitrate     string
+	Deinterlace bool
+	ExtraArgs   string
+}
+
+type ImportJob struct {
+	ID                 uint `gorm:"primaryKey"`
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
+	PlaylistID         uint `gorm:"index"`
+	StartedAt          time.Time
+	FinishedAt         time.Time
+	Status             string
+	Phase              string
+	Total              int // Items of the current phase
+	Processed          int
+	CategoriesCreated  int
+	CategoriesUpdated  int
+	CategoriesDeleted  int
+	ChannelsCreated    int
+	ChannelsUpdated    int
+	ChannelsDeleted    int
+	ProgrammesInserted int
+	Error              string
+}
+
+// EpgSource is an XMLTV guide independent of playlists, that any channel can
+// take its programmes from.
+type EpgSource struct {
+	ID              uint `gorm:"primaryKey"`
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+	Name            string
+	URL             string // http(s), file:// or local path, gzipped or not
+	RefreshSchedule string // Interval like 12h or cron expression, empty to refresh twice a day
+	LastRefreshAt   time.Time
+	NextRefreshAt   time.Time
+	Status          int // 0 never loaded, 1 loading, 2 loaded, -1 failed
+	Error           string
+}
+
+// EpgChannel is a channel listed by a loaded guide, of a playlist or an EPG source.
+type EpgChannel struct {
+	ID           uint     `gorm:"primaryKey"`
+	PlaylistID   uint     `gorm:"index"`
+	EpgSourceID  uint     `gorm:"index"`
+	EpgID        string   `gorm:"index"`
+	DisplayNames []string `gorm:"serializer:json"`
+	Icon         string
+}
+
+type Recording struct {
+	ID          uint `gorm:"primaryKey"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	ChannelID   int `gorm:"index"`
+	ProgrammeID uint
+	RuleID      uint `gorm:"index"`
+	Title       string
+	Description string
+	EpisodeNum  string
+	Start       time.Time
+	Stop        time.Time
+	PrePadding  int    // Minutes
+	PostPadding int    // Minutes
+	Status      string `gorm:"index"`
+	Error       string
+	FilePath    string
+	Size        int64
+}
+
+type RecordingRule struct {
+	ID           uint `gorm:"primaryKey"`
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	Title        string
+	EpgChannelID string
+	PrePadding   int // Minutes
+	PostPadding  int // Minutes
+	Active       bool
 }
 
 func InitializeDatabase() {
@@ -92,7 +270,8 @@ func InitializeDatabase() {
 	}
 
 	var err error
-	DB, err = gorm.Open(sqlite.Open(filepath.Join(dbPath, dbFile)), &gorm.Config{})
+	// Concurrent writers, like an import and a user edit, wait for each other instead of failing with "database is locked"
+	DB, err = gorm.Open(sqlite.Open(filepath.Join(dbPath, dbFile)+"?_pragma=busy_timeout(60000)"), &gorm.Config{})
 	if err != nil {
 		log.Fatalf("Failed to open database: %v", err)
 	}
@@ -100,9 +279,20 @@ func InitializeDatabase() {
 	DB.Exec(`PRAGMA wal_checkpoint(RESTART);`)
 	DB.Exec(`PRAGMA cache_size=10000; PRAGMA journal_mode=WAL; PRAGMA temp_store=MEMORY; PRAGMA synchronous=OFF;`)
 
-	// Running the migrations for each model
-	err = DB.AutoMigrate(&Playlist{}, &Category{}, &Channel{}, &Programme{})
+	err = migrate(DB)
 	if err != nil {
 		log.Fatalf("Failed to migrate database: %v", err)
 	}
+
+	err = seedTranscodeProfiles()
+	if err != nil {
+		log.Fatalf("Failed to create default transcode profiles: %v", err)
+	}
+}
+
+// migrate runs the migrations for each model.
+func migrate(db *gorm.DB) error {
+	return db.AutoMigrate(&Playlist{}, &Category{}, &Channel{}, &Programme{}, &TranscodeProfile{}, &Recording{}, &RecordingRule{},
+		&VodCategory{}, &Movie{}, &Series{}, &Episode{}, &ImportJob{},
+		&EpgSource{}, &EpgChannel{})
 }
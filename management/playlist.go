@@ -1,6 +1,13 @@
 package management
 
-import "log"
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+// Tuners announced for playlists whose provider doesn't report max_connections
+const defaultTunerCount = 2
 
 func (p *Playlist) Save() error {
 	result := DB.Create(p)
@@ -13,17 +20,22 @@ func (p *Playlist) Save() error {
 
 func (p *Playlist) Update() error {
 	result := DB.Model(&Playlist{}).Where("id = ?", p.ID).UpdateColumns(map[string]interface{}{
-		"Description":  p.Description,
-		"Server":       p.Server,
-		"Username":     p.Username,
-		"Password":     p.Password,
-		"Type":         p.Type,
-		"XmltvURL":     p.XmltvURL,
-		"M3uURL":       p.M3uURL,
-		"ImportStatus": p.ImportStatus,
-		"Restream":     p.Restream,
-		"ExpiresAt":    p.ExpiresAt,
-		"Expired":      p.Expired,
+		"Description":        p.Description,
+		"Server":             p.Server,
+		"Username":           p.Username,
+		"Password":           p.Password,
+		"Type":               p.Type,
+		"XmltvURL":           p.XmltvURL,
+		"M3uURL":             p.M3uURL,
+		"ImportStatus":       p.ImportStatus,
+		"Restream":           p.Restream,
+		"Passthrough":        p.Passthrough,
+		"ExpiresAt":          p.ExpiresAt,
+		"Expired":            p.Expired,
+		"MaxConnections":     p.MaxConnections,
+		"PreemptOldest":      p.PreemptOldest,
+		"TranscodeProfileID": p.TranscodeProfileID,
+		"RefreshSchedule":    p.RefreshSchedule,
 	})
 	if result.Error != nil {
 		return result.Error
@@ -33,10 +45,21 @@ func (p *Playlist) Update() error {
 }
 
 func (p *Playlist) Delete() error {
-	// Manually delete the associated Channels, Categories and Programmes using raw SQL
+	// Not in the middle of an import swapping in the programmes of the playlist
+	mutexEPG.Lock()
+	defer mutexEPG.Unlock()
+
+	// Manually delete the associated Channels, Categories, Programmes and VOD using raw SQL
 	DB.Exec("DELETE FROM programmes WHERE channel_id IN (SELECT id FROM channels WHERE category_id IN (SELECT id FROM categories WHERE playlist_id = ?))", p.ID)
 	DB.Exec("DELETE FROM channels WHERE category_id IN (SELECT id FROM categories WHERE playlist_id = ?)", p.ID)
 	DB.Exec("DELETE FROM categories WHERE playlist_id = ?", p.ID)
+	DB.Exec("DELETE FROM episodes WHERE series_id IN (SELECT id FROM series WHERE playlist_id = ?)", p.ID)
+	DB.Exec("DELETE FROM series WHERE playlist_id = ?", p.ID)
+	DB.Exec("DELETE FROM movies WHERE playlist_id = ?", p.ID)
+	DB.Exec("DELETE FROM vod_categories WHERE playlist_id = ?", p.ID)
+	DB.Exec("DELETE FROM import_jobs WHERE playlist_id = ?", p.ID)
+	DB.Exec("DELETE FROM epg_channels WHERE playlist_id = ?", p.ID)
+	os.Remove(m3uFilePath(p.ID))
 
 	// Finally, delete the Playlist
 	result := DB.Unscoped().Delete(&p)
@@ -91,3 +114,41 @@ func NewPlaylist(server string, username string, password string, playlistType s
 
 	return playlist, nil
 }
+
+// SetMaxConnections stores the connection limit reported by the provider.
+func (p *Playlist) SetMaxConnections(userInfo UserInfo) {
+	maxConnections, err := strconv.Atoi(userInfo.MaxConnections)
+	if err == nil && maxConnections > 0 {
+		p.MaxConnections = maxConnections
+	}
+}
+
+// saveAccountInfo saves what the provider says of the account alone.
+func (p *Playlist) saveAccountInfo() error {
+	return DB.Model(&Playlist{}).Where("id = ?", p.ID).UpdateColumns(map[string]interface{}{
+		"ExpiresAt":      p.ExpiresAt,
+		"Expired":        p.Expired,
+		"MaxConnections": p.MaxConnections,
+	}).Error
+}
+
+// GetTunerCount returns the number of simultaneous streams all the active
+// playlists can serve together.
+func GetTunerCount() (int, error) {
+	var playlists []Playlist
+	result := DB.Where("expired = ?", false).Find(&playlists)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+
+	tunerCount := 0
+	for _, playlist := range playlists {
+		if playlist.MaxConnections > 0 {
+			tunerCount += playlist.MaxConnections
+		} else {
+			tunerCount += defaultTunerCount
+		}
+	}
+
+	return tunerCount, nil
+}
@@ -0,0 +1,178 @@
+package management
+
+import (
+	"errors"
+	"fmt"
+	"livestream-companion/stream"
+	"regexp"
+	"strings"
+)
+
+// Profile used when neither the request, the channel nor the playlist ask for one
+var defaultTranscodeProfile = TranscodeProfile{Name: "copy"}
+
+// Profiles matching the options that used to be hardcoded in the stream handler
+var builtinTranscodeProfiles = []TranscodeProfile{
+	{
+		Name: "copy",
+	},
+	{
+		Name:       "webbrowser",
+		AudioCodec: "libmp3lame",
+	},
+	{
+		Name:        "lq",
+		VideoCodec:  "libx264",
+		AudioCodec:  "libmp3lame",
+		Resolution:  "720x574",
+		Bitrate:     "1640k",
+		Deinterlace: true,
+		ExtraArgs:   "-bufsize 1280k -sc_threshold 0 -keyint_min 75 -r 25 -pix_fmt yuv420p -preset veryfast -profile:v high -x264opts subme=0:me_range=4:rc_lookahead=10:partitions=none -crf 23",
+	},
+}
+
+func seedTranscodeProfiles() error {
+	var count int64
+	if err := DB.Model(&TranscodeProfile{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	profiles := make([]TranscodeProfile, len(builtinTranscodeProfiles))
+	copy(profiles, builtinTranscodeProfiles)
+
+	return DB.Create(&profiles).Error
+}
+
+// WIDTHxHEIGHT, where -1 or -2 keeps the aspect ratio as ffmpeg scale does
+var profileResolution = regexp.MustCompile(`^(-[12]|\d+)x(-[12]|\d+)$`)
+
+func (p *TranscodeProfile) validate() error {
+	if p.Name == "" {
+		return errors.New("Name is required")
+	}
+	if p.Resolution != "" && !profileResolution.MatchString(p.Resolution) {
+		return fmt.Errorf("invalid resolution %q, expected WIDTHxHEIGHT", p.Resolution)
+	}
+	if err := stream.CheckExtraArgs(strings.Fields(p.ExtraArgs)); err != nil {
+		return fmt.Errorf("invalid extra arguments: %w", err)
+	}
+	return nil
+}
+
+func (p *TranscodeProfile) Save() error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	result := DB.Create(p)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	return nil
+}
+
+func (p *TranscodeProfile) Update() error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	result := DB.Model(&TranscodeProfile{}).Where("id = ?", p.ID).UpdateColumns(map[string]interface{}{
+		"Name":        p.Name,
+		"VideoCodec":  p.VideoCodec,
+		"AudioCodec":  p.AudioCodec,
+		"Resolution":  p.Resolution,
+		"Bitrate":     p.Bitrate,
+		"Deinterlace": p.Deinterlace,
+		"ExtraArgs":   p.ExtraArgs,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	return nil
+}
+
+func (p *TranscodeProfile) Delete() error {
+	// Channels and playlists using it fall back to the default profile
+	DB.Model(&Channel{}).Where("transcode_profile_id = ?", p.ID).Update("TranscodeProfileID", 0)
+	DB.Model(&Playlist{}).Where("transcode_profile_id = ?", p.ID).Update("TranscodeProfileID", 0)
+
+	result := DB.Unscoped().Delete(p)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	return nil
+}
+
+// StreamProfile converts the profile to the options understood by the stream
+// package. ExtraArgs is split on whitespace, quoting is not supported.
+func (p *TranscodeProfile) StreamProfile() stream.Profile {
+	return stream.Profile{
+		Name:        p.Name,
+		VideoCodec:  p.VideoCodec,
+		AudioCodec:  p.AudioCodec,
+		Resolution:  p.Resolution,
+		Bitrate:     p.Bitrate,
+		Deinterlace: p.Deinterlace,
+		ExtraArgs:   strings.Fields(p.ExtraArgs),
+	}
+}
+
+func GetTranscodeProfiles() ([]TranscodeProfile, error) {
+	var profiles []TranscodeProfile
+	result := DB.Order("name asc").Find(&profiles)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return profiles, nil
+}
+
+func GetTranscodeProfileByID(id uint) (*TranscodeProfile, error) {
+	var profile TranscodeProfile
+	result := DB.First(&profile, id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &profile, nil
+}
+
+func GetTranscodeProfileByName(name string) (*TranscodeProfile, error) {
+	var profile TranscodeProfile
+	result := DB.Where("name = ?", name).First(&profile)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &profile, nil
+}
+
+// ResolveTranscodeProfile picks the profile for a stream: the one requested by
+// name, then the channel default, then the playlist default.
+// The channel must have its Category.Playlist loaded.
+func ResolveTranscodeProfile(name string, channel *Channel) (*TranscodeProfile, error) {
+	if name != "" {
+		return GetTranscodeProfileByName(name)
+	}
+
+	if channel.TranscodeProfileID != 0 {
+		if profile, err := GetTranscodeProfileByID(channel.TranscodeProfileID); err == nil {
+			return profile, nil
+		}
+	}
+
+	if channel.Category.Playlist.TranscodeProfileID != 0 {
+		if profile, err := GetTranscodeProfileByID(channel.Category.Playlist.TranscodeProfileID); err == nil {
+			return profile, nil
+		}
+	}
+
+	profile := defaultTranscodeProfile
+	return &profile, nil
+}
@@ -0,0 +1,442 @@
+package management
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"livestream-companion/stream"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RecordingScheduled = "scheduled"
+	RecordingRecording = "recording"
+	RecordingDone      = "done"
+	RecordingFailed    = "failed"
+)
+
+// RecordingsDir is where the recorded streams are written.
+var RecordingsDir = "./recordings"
+
+// Minutes added before and after a recording when the request doesn't say.
+var DefaultPrePadding = 1
+var DefaultPostPadding = 5
+
+// How often the scheduler looks for recordings to start.
+const recordingCheckInterval = 10 * time.Second
+
+// How long a recording waits before tuning again when the stream drops.
+const recordingRetryDelay = 10 * time.Second
+
+// RecordingConflictError is returned when a recording would need more tuners
+// than its playlist has while other recordings are running.
+type RecordingConflictError struct {
+	PlaylistID     uint
+	MaxConnections int
+	Conflicts      []Recording
+}
+
+func (e *RecordingConflictError) Error() string {
+	return fmt.Sprintf("all %d tuners of playlist %d are taken by other recordings", e.MaxConnections, e.PlaylistID)
+}
+
+var activeRecordings = make(map[uint]context.CancelFunc)
+var mutexRecordings = &sync.Mutex{}
+
+// Schedule fills in the recording from its programme, if any, checks it fits
+// in the tuners of the playlist and saves it as scheduled.
+func (r *Recording) Schedule() error {
+	// Only the recorder decides where and how much it records
+	r.FilePath = ""
+	r.Size = 0
+	r.Error = ""
+
+	if err := r.prepare(true); err != nil {
+		return err
+	}
+
+	r.Status = RecordingScheduled
+	return r.Save()
+}
+
+// prepare checks the recording can be made. The start, stop and channel are
+// copied from the programme only when it is new, as guide updates give the
+// programmes new IDs.
+func (r *Recording) prepare(newProgramme bool) error {
+	if r.ProgrammeID != 0 && newProgramme {
+		programme, err := GetProgrammeByID(r.ProgrammeID)
+		if err != nil {
+			return err
+		}
+
+		r.Start, r.Stop, err = programme.Times()
+		if err != nil {
+			return err
+		}
+		r.ChannelID = programme.ChannelID
+		if r.Title == "" {
+			r.Title = programme.Title
+		}
+		if r.Description == "" {
+			r.Description = programme.Desc
+		}
+		if r.EpisodeNum == "" {
+			r.EpisodeNum = programme.EpisodeKey()
+		}
+	}
+
+	if r.ChannelID == 0 {
+		return errors.New("a recording needs a channel or a programme")
+	}
+	if !r.Stop.After(r.Start) {
+		return errors.New("the recording must stop after it starts")
+	}
+	if r.PrePadding < 0 || r.PostPadding < 0 {
+		return errors.New("padding can't be negative")
+	}
+	if _, end := r.Window(); end.Before(time.Now()) {
+		return errors.New("the recording is already over")
+	}
+
+	return r.checkConflicts()
+}
+
+// Window returns when the recording actually starts and stops, padding included.
+func (r *Recording) Window() (time.Time, time.Time) {
+	return r.Start.Add(-time.Duration(r.PrePadding) * time.Minute), r.Stop.Add(time.Duration(r.PostPadding) * time.Minute)
+}
+
+func (r *Recording) overlaps(begin time.Time, end time.Time) bool {
+	otherBegin, otherEnd := r.Window()
+	return otherBegin.Before(end) && otherEnd.After(begin)
+}
+
+// checkConflicts makes sure that at no point during the recording more
+// channels of the playlist are being recorded than it has tuners. Recordings
+// of the same channel share a single connection.
+func (r *Recording) checkConflicts() error {
+	channel, err := GetChannelWithPlaylistByID(uint(r.ChannelID))
+	if err != nil {
+		return err
+	}
+
+	playlist := channel.Category.Playlist
+	if playlist.MaxConnections <= 0 {
+		return nil
+	}
+
+	var others []Recording
+	result := DB.Joins("JOIN channels ON channels.id = recordings.channel_id").
+		Joins("JOIN categories ON categories.id = channels.category_id").
+		Where("categories.playlist_id = ? AND recordings.status IN ? AND recordings.id <> ?",
+			playlist.ID, []string{RecordingScheduled, RecordingRecording}, r.ID).
+		Find(&others)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	begin, end := r.Window()
+
+	// The number of channels only goes up when a recording starts, so checking
+	// at every start inside our window is enough
+	instants := []time.Time{begin}
+	for _, other := range others {
+		if otherBegin, _ := other.Window(); otherBegin.After(begin) && otherBegin.Before(end) {
+			instants = append(instants, otherBegin)
+		}
+	}
+
+	for _, instant := range instants {
+		channels := map[int]bool{r.ChannelID: true}
+		var conflicts []Recording
+		for _, other := range others {
+			if other.overlaps(instant, instant.Add(time.Nanosecond)) {
+				channels[other.ChannelID] = true
+				conflicts = append(conflicts, other)
+			}
+		}
+
+		if len(channels) > playlist.MaxConnections {
+			return &RecordingConflictError{
+				PlaylistID:     playlist.ID,
+				MaxConnections: playlist.MaxConnections,
+				Conflicts:      conflicts,
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *Recording) Save() error {
+	result := DB.Create(r)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	return nil
+}
+
+// Update changes a recording that has not started yet.
+func (r *Recording) Update() error {
+	if r.Status != RecordingScheduled {
+		return fmt.Errorf("can't change a recording that is %s", r.Status)
+	}
+
+	var stored Recording
+	if err := DB.First(&stored, r.ID).Error; err != nil {
+		return err
+	}
+
+	if err := r.prepare(r.ProgrammeID != stored.ProgrammeID); err != nil {
+		return err
+	}
+
+	result := DB.Model(&Recording{}).Where("id = ?", r.ID).UpdateColumns(map[string]interface{}{
+		"ChannelID":   r.ChannelID,
+		"ProgrammeID": r.ProgrammeID,
+		"Title":       r.Title,
+		"Description": r.Description,
+		"EpisodeNum":  r.EpisodeNum,
+		"Start":       r.Start,
+		"Stop":        r.Stop,
+		"PrePadding":  r.PrePadding,
+		"PostPadding": r.PostPadding,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	return nil
+}
+
+// Delete stops the recording if it is running and removes it with its file.
+func (r *Recording) Delete() error {
+	mutexRecordings.Lock()
+	if cancel, ok := activeRecordings[r.ID]; ok {
+		cancel()
+	}
+	mutexRecordings.Unlock()
+
+	if r.FilePath != "" {
+		path, err := r.File()
+		if err != nil {
+			// Never remove a file that isn't a recording
+			log.Print(err)
+		} else if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	result := DB.Unscoped().Delete(r)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	return nil
+}
+
+func (r *Recording) setStatus(status string, err error) {
+	r.Status = status
+	r.Error = ""
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	if err := DB.Model(&Recording{}).Where("id = ?", r.ID).UpdateColumns(map[string]interface{}{
+		"Status":   r.Status,
+		"Error":    r.Error,
+		"FilePath": r.FilePath,
+		"Size":     r.Size,
+	}).Error; err != nil {
+		log.Printf("Failed to save recording %d as %s: %v", r.ID, status, err)
+	}
+}
+
+// File returns the path of the recorded stream, refusing any outside of the
+// recordings directory.
+func (r *Recording) File() (string, error) {
+	dir, err := filepath.Abs(RecordingsDir)
+	if err != nil {
+		return "", err
+	}
+	path, err := filepath.Abs(r.FilePath)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("recording file %s is outside of %s", r.FilePath, RecordingsDir)
+	}
+
+	return path, nil
+}
+
+func GetRecordings() ([]Recording, error) {
+	var recordings []Recording
+	result := DB.Order("start asc").Find(&recordings)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return recordings, nil
+}
+
+func GetRecordingByID(id uint) (*Recording, error) {
+	var recording Recording
+	result := DB.First(&recording, id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &recording, nil
+}
+
+// RunRecordings starts the recordings as they come due. It never returns.
+func RunRecordings() {
+	// Recordings cut short by a restart are resumed if they are not over yet
+	DB.Model(&Recording{}).Where("status = ?", RecordingRecording).Update("Status", RecordingScheduled)
+
+	for {
+		startDueRecordings()
+		time.Sleep(recordingCheckInterval)
+	}
+}
+
+func startDueRecordings() {
+	var recordings []Recording
+	if err := DB.Where("status = ?", RecordingScheduled).Find(&recordings).Error; err != nil {
+		log.Printf("Failed to fetch scheduled recordings: %v", err)
+		return
+	}
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].Start.Before(recordings[j].Start)
+	})
+
+	now := time.Now()
+	for i := range recordings {
+		recording := &recordings[i]
+		begin, end := recording.Window()
+
+		if !end.After(now) {
+			log.Printf("Recording %d of %q was missed", recording.ID, recording.Title)
+			recording.setStatus(RecordingFailed, errors.New("missed"))
+			continue
+		}
+		if begin.After(now) {
+			continue
+		}
+
+		mutexRecordings.Lock()
+		_, running := activeRecordings[recording.ID]
+		if !running {
+			ctx, cancel := context.WithDeadline(context.Background(), end)
+			activeRecordings[recording.ID] = cancel
+			go recording.record(ctx)
+		}
+		mutexRecordings.Unlock()
+	}
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^\pL\pN._-]+`)
+
+func (r *Recording) fileName() string {
+	title := unsafeFileChars.ReplaceAllString(r.Title, "_")
+	return fmt.Sprintf("%d-%s-%s.ts", r.ID, title, r.Start.Local().Format("20060102-1504"))
+}
+
+// record captures the channel into the recordings directory until the end of
+// the window. When the stream drops it tunes again, appending to the same file.
+func (r *Recording) record(ctx context.Context) {
+	defer func() {
+		mutexRecordings.Lock()
+		activeRecordings[r.ID]()
+		delete(activeRecordings, r.ID)
+		mutexRecordings.Unlock()
+	}()
+
+	channel, err := GetChannelWithPlaylistByID(uint(r.ChannelID))
+	if err != nil {
+		r.setStatus(RecordingFailed, err)
+		return
+	}
+
+	profile, err := ResolveTranscodeProfile("", channel)
+	if err != nil {
+		r.setStatus(RecordingFailed, err)
+		return
+	}
+
+	failover, err := GetFailoverSources(channel)
+	if err != nil {
+		r.setStatus(RecordingFailed, err)
+		return
+	}
+
+	if err := os.MkdirAll(RecordingsDir, 0755); err != nil {
+		r.setStatus(RecordingFailed, err)
+		return
+	}
+	if r.FilePath == "" {
+		r.FilePath = filepath.Join(RecordingsDir, r.fileName())
+	}
+
+	file, err := os.OpenFile(r.FilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		r.setStatus(RecordingFailed, err)
+		return
+	}
+	defer file.Close()
+
+	log.Printf("Recording %d of %q started on channel %d", r.ID, r.Title, r.ChannelID)
+	r.setStatus(RecordingRecording, nil)
+
+	tune := stream.Tune{
+		Source:   channelSource(channel),
+		Failover: failover,
+		Profile:  profile.StreamProfile(),
+	}
+	usePassthrough(&tune, channel, "")
+	name := fmt.Sprintf("Recording %d: %s", r.ID, r.Title)
+
+	var lastErr error
+	for ctx.Err() == nil {
+		written, err := stream.Record(ctx, tune, file, name)
+		r.Size += written
+		if err == nil {
+			break
+		}
+
+		lastErr = err
+		log.Printf("Recording %d of %q interrupted: %v", r.ID, r.Title, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(recordingRetryDelay):
+		}
+	}
+
+	// A deleted recording has nothing left to update
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return
+	}
+
+	if r.Size == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("no data received")
+		}
+		log.Printf("Recording %d of %q failed: %v", r.ID, r.Title, lastErr)
+		r.setStatus(RecordingFailed, lastErr)
+		return
+	}
+
+	log.Printf("Recording %d of %q done, %d bytes", r.ID, r.Title, r.Size)
+	r.setStatus(RecordingDone, lastErr)
+}
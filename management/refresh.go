@@ -0,0 +1,139 @@
+package management
+
+import (
+	"log"
+	"time"
+)
+
+const refreshCheckInterval = time.Minute
+
+// RefreshStagger is the pause between two scheduled imports, so playlists
+// due at the same time don't all hit their providers at once.
+var RefreshStagger = time.Minute
+
+// setImportStatus saves the import status alone, so a long import never
+// writes back settings changed while it ran.
+func (p *Playlist) setImportStatus(status int) error {
+	p.ImportStatus = status
+	return DB.Model(&Playlist{}).Where("id = ?", p.ID).UpdateColumn("ImportStatus", p.ImportStatus).Error
+}
+
+// refreshed records an import of the playlist starting at start, and plans
+// the next one from its schedule.
+func (p *Playlist) refreshed(start time.Time) error {
+	p.LastRefreshAt = start
+	p.NextRefreshAt = time.Time{}
+	if schedule, err := ParseSchedule(p.RefreshSchedule); err == nil && schedule != nil {
+		p.NextRefreshAt = schedule.Next(start)
+	}
+
+	return DB.Model(&Playlist{}).Where("id = ?", p.ID).UpdateColumns(map[string]interface{}{
+		"LastRefreshAt": p.LastRefreshAt,
+		"NextRefreshAt": p.NextRefreshAt,
+	}).Error
+}
+
+// RunScheduledRefresh re-imports the playlists and reloads the EPG sources
+// when their schedule is due, one after the other.
+func RunScheduledRefresh() {
+	// Imports cut short by a restart would otherwise look busy forever
+	DB.Model(&Playlist{}).Where("import_status = ?", 1).Update("ImportStatus", -1)
+	DB.Model(&ImportJob{}).Where("status = ?", ImportRunning).UpdateColumns(map[string]interface{}{
+		"Status": ImportFailed,
+		"Error":  "interrupted by a restart",
+	})
+	DB.Model(&EpgSource{}).Where("status = ?", 1).UpdateColumns(map[string]interface{}{
+		"Status": -1,
+		"Error":  "interrupted by a restart",
+	})
+
+	for {
+		refreshDuePlaylists()
+		refreshDueEpgSources()
+		time.Sleep(refreshCheckInterval)
+	}
+}
+
+func refreshDuePlaylists() {
+	var playlists []Playlist
+	if err := DB.Where("COALESCE(refresh_schedule, '') <> ''").Order("next_refresh_at asc").Find(&playlists).Error; err != nil {
+		log.Printf("Failed to fetch scheduled playlists: %v", err)
+		return
+	}
+
+	first := true
+	for i := range playlists {
+		playlist := &playlists[i]
+
+		schedule, err := ParseSchedule(playlist.RefreshSchedule)
+		if err != nil {
+			log.Printf("Playlist %d: %v", playlist.ID, err)
+			continue
+		}
+
+		// A schedule that was just set starts counting from now
+		if playlist.NextRefreshAt.IsZero() {
+			next := schedule.Next(time.Now())
+			DB.Model(&Playlist{}).Where("id = ?", playlist.ID).UpdateColumn("NextRefreshAt", next)
+			continue
+		}
+
+		if playlist.NextRefreshAt.After(time.Now()) {
+			continue
+		}
+
+		// Reload, an import may have been started by hand in the meantime
+		playlist, err = GetPlaylistByID(playlist.ID)
+		if err != nil || playlist.ImportStatus == 1 || playlist.NextRefreshAt.After(time.Now()) {
+			continue
+		}
+
+		if !first {
+			time.Sleep(RefreshStagger)
+		}
+		first = false
+
+		log.Printf("Scheduled refresh of playlist %d", playlist.ID)
+		ImportPlaylist(playlist.ID)
+	}
+}
+
+func refreshDueEpgSources() {
+	var sources []EpgSource
+	if err := DB.Where("refresh_schedule <> ''").Order("next_refresh_at asc").Find(&sources).Error; err != nil {
+		log.Printf("Failed to fetch scheduled EPG sources: %v", err)
+		return
+	}
+
+	first := true
+	for i := range sources {
+		source := &sources[i]
+
+		schedule, err := ParseSchedule(source.RefreshSchedule)
+		if err != nil {
+			log.Printf("EPG source %d: %v", source.ID, err)
+			continue
+		}
+
+		// A schedule that was just set starts counting from now
+		if source.NextRefreshAt.IsZero() {
+			next := schedule.Next(time.Now())
+			DB.Model(&EpgSource{}).Where("id = ?", source.ID).UpdateColumn("NextRefreshAt", next)
+			continue
+		}
+
+		if source.NextRefreshAt.After(time.Now()) || source.Status == 1 {
+			continue
+		}
+
+		if !first {
+			time.Sleep(RefreshStagger)
+		}
+		first = false
+
+		log.Printf("Scheduled refresh of EPG source %d", source.ID)
+		if err := source.Refresh(); err != nil {
+			log.Print(err)
+		}
+	}
+}
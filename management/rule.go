@@ -0,0 +1,178 @@
+package management
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+func (r *RecordingRule) Save() error {
+	if strings.TrimSpace(r.Title) == "" {
+		return errors.New("a rule needs a title to match")
+	}
+
+	result := DB.Create(r)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	return nil
+}
+
+func (r *RecordingRule) Update() error {
+	if strings.TrimSpace(r.Title) == "" {
+		return errors.New("a rule needs a title to match")
+	}
+
+	result := DB.Model(&RecordingRule{}).Where("id = ?", r.ID).UpdateColumns(map[string]interface{}{
+		"Title":        r.Title,
+		"EpgChannelID": r.EpgChannelID,
+		"PrePadding":   r.PrePadding,
+		"PostPadding":  r.PostPadding,
+		"Active":       r.Active,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	return nil
+}
+
+// Delete removes the rule along with the recordings it scheduled that did not
+// start yet.
+func (r *RecordingRule) Delete() error {
+	DB.Where("rule_id = ? AND status = ?", r.ID, RecordingScheduled).Delete(&Recording{})
+
+	result := DB.Unscoped().Delete(r)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	return nil
+}
+
+func GetRecordingRules() ([]RecordingRule, error) {
+	var rules []RecordingRule
+	result := DB.Order("title asc").Find(&rules)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return rules, nil
+}
+
+func GetRecordingRuleByID(id uint) (*RecordingRule, error) {
+	var rule RecordingRule
+	result := DB.First(&rule, id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &rule, nil
+}
+
+// ApplyRecordingRules schedules the upcoming programmes matching the active
+// rules. Runs on the whole guide, so it is safe to call after any EPG update.
+func ApplyRecordingRules() {
+	var rules []RecordingRule
+	if err := DB.Where("active = ?", true).Find(&rules).Error; err != nil {
+		log.Printf("Failed to fetch recording rules: %v", err)
+		return
+	}
+
+	for _, rule := range rules {
+		if err := rule.Apply(); err != nil {
+			log.Printf("Failed to apply recording rule %d for %q: %v", rule.ID, rule.Title, err)
+		}
+	}
+}
+
+// Apply schedules a recording for every upcoming programme with the title of
+// the rule, on any channel with its EPG id or on every channel when it has
+// none. Episodes already recorded or scheduled are skipped.
+func (r *RecordingRule) Apply() error {
+	query := DB.Joins("JOIN channels ON channels.id = programmes.channel_id").
+		Where("LOWER(programmes.title) = LOWER(?)", strings.TrimSpace(r.Title))
+	if r.EpgChannelID != "" {
+		query = query.Where("channels.epg_channel_id = ?", r.EpgChannelID)
+	}
+
+	var programmes []Programme
+	if err := query.Order("programmes.channel_id asc").Find(&programmes).Error; err != nil {
+		return err
+	}
+
+	type airing struct {
+		programme Programme
+		start     time.Time
+		stop      time.Time
+	}
+
+	// The same airing shows up once per channel sharing the EPG id, the first
+	// channel with a tuner free gets it
+	var airings []airing
+	now := time.Now()
+	for _, programme := range programmes {
+		start, stop, err := programme.Times()
+		if err != nil || !stop.After(now) {
+			continue
+		}
+		airings = append(airings, airing{programme, start, stop})
+	}
+	sort.SliceStable(airings, func(i, j int) bool {
+		return airings[i].start.Before(airings[j].start)
+	})
+
+	for _, airing := range airings {
+		programme := airing.programme
+
+		recorded, err := episodeRecorded(&programme, airing.start)
+		if err != nil {
+			return err
+		}
+		if recorded {
+			continue
+		}
+
+		recording := Recording{
+			ProgrammeID: programme.ID,
+			RuleID:      r.ID,
+			PrePadding:  r.PrePadding,
+			PostPadding: r.PostPadding,
+		}
+		if err := recording.Schedule(); err != nil {
+			log.Printf("Rule %d can't record %q on channel %d: %v", r.ID, programme.Title, programme.ChannelID, err)
+			continue
+		}
+
+		log.Printf("Rule %d scheduled %q on channel %d at %s", r.ID, programme.Title, programme.ChannelID, airing.start)
+	}
+
+	return nil
+}
+
+// episodeRecorded reports whether the episode was already recorded or is
+// scheduled, going by its episode number, or its description when there is
+// none. Without either only the same airing counts as a duplicate.
+func episodeRecorded(programme *Programme, start time.Time) (bool, error) {
+	query := DB.Model(&Recording{}).
+		Where("LOWER(title) = LOWER(?) AND status <> ?", programme.Title, RecordingFailed)
+
+	switch {
+	case programme.EpisodeKey() != "":
+		query = query.Where("episode_num = ?", programme.EpisodeKey())
+	case programme.Desc != "":
+		query = query.Where("description = ?", programme.Desc)
+	default:
+		query = query.Where("start = ?", start)
+	}
+
+	var count int64
+	if err := query.Count(&count).Error; err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
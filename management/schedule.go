@@ -0,0 +1,177 @@
+package management
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule tells when a periodic task runs next.
+type Schedule interface {
+	Next(after time.Time) time.Time
+}
+
+// ParseSchedule reads either an interval like "6h" or "90m", or a cron
+// expression with the five usual fields like "30 4 * * *". The @hourly,
+// @daily and @weekly shortcuts are accepted too. An empty spec is no schedule.
+func ParseSchedule(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	switch spec {
+	case "":
+		return nil, nil
+	case "@hourly":
+		spec = "0 * * * *"
+	case "@daily":
+		spec = "0 0 * * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	}
+
+	if interval, err := time.ParseDuration(spec); err == nil {
+		if interval < time.Minute {
+			return nil, fmt.Errorf("the interval %q is shorter than a minute", spec)
+		}
+		return intervalSchedule(interval), nil
+	}
+
+	return parseCron(spec)
+}
+
+type intervalSchedule time.Duration
+
+func (s intervalSchedule) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(s))
+}
+
+// cronSchedule has a bit set per allowed minute, hour, day, month and weekday.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// Day of month and weekday restricted both: either one is enough, as in cron
+	domAndDow bool
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+func parseCron(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("invalid schedule %q, expected an interval like 6h or a cron expression like \"0 4 * * *\"", spec)
+	}
+
+	var bits [5]uint64
+	for i, field := range fields {
+		var err error
+		bits[i], err = parseCronField(field, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s in schedule %q: %w", cronFields[i].name, spec, err)
+		}
+	}
+
+	// Sunday is both 0 and 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+
+	schedule := &cronSchedule{
+		minute:    bits[0],
+		hour:      bits[1],
+		dom:       bits[2],
+		month:     bits[3],
+		dow:       bits[4],
+		domAndDow: !strings.HasPrefix(fields[2], "*") && !strings.HasPrefix(fields[4], "*"),
+	}
+
+	// A day that no month has, like "0 0 30 2 *", would never run
+	if schedule.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("schedule %q never matches a date", spec)
+	}
+
+	return schedule, nil
+}
+
+// parseCronField reads a comma separated list of *, n, n-m, with an optional /step.
+func parseCronField(field string, min int, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("bad step %q", stepPart)
+			}
+		}
+
+		first, last := min, max
+		if rangePart != "*" {
+			low, high, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if first, err = strconv.Atoi(low); err != nil {
+				return 0, fmt.Errorf("bad value %q", low)
+			}
+			last = first
+			if isRange {
+				if last, err = strconv.Atoi(high); err != nil {
+					return 0, fmt.Errorf("bad value %q", high)
+				}
+			} else if hasStep {
+				last = max
+			}
+		}
+		if first < min || last > max || first > last {
+			return 0, fmt.Errorf("%q is out of %d-%d", rangePart, min, max)
+		}
+
+		for value := first; value <= last; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+
+	return bits, nil
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAndDow {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+// Next returns the first matching minute after the given time, or the zero
+// time when there is none within five years.
+func (s *cronSchedule) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
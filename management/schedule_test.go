@@ -0,0 +1,129 @@
+package management
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		field    string
+		min, max int
+		want     []int
+	}{
+		{"*", 0, 5, []int{0, 1, 2, 3, 4, 5}},
+		{"3", 0, 59, []int{3}},
+		{"1,5,9", 0, 59, []int{1, 5, 9}},
+		{"10-13", 0, 59, []int{10, 11, 12, 13}},
+		{"*/15", 0, 59, []int{0, 15, 30, 45}},
+		{"5/20", 0, 59, []int{5, 25, 45}},
+		{"1-10/3", 1, 31, []int{1, 4, 7, 10}},
+		{"0-4/2,20", 0, 23, []int{0, 2, 4, 20}},
+		{"7", 0, 7, []int{7}},
+	}
+
+	for _, test := range tests {
+		bits, err := parseCronField(test.field, test.min, test.max)
+		if err != nil {
+			t.Errorf("%s: %v", test.field, err)
+			continue
+		}
+
+		var want uint64
+		for _, value := range test.want {
+			want |= 1 << uint(value)
+		}
+		if bits != want {
+			t.Errorf("%s: bits %b, want %b", test.field, bits, want)
+		}
+	}
+}
+
+func TestParseCronFieldErrors(t *testing.T) {
+	tests := []struct {
+		field    string
+		min, max int
+	}{
+		{"60", 0, 59},
+		{"0", 1, 31},
+		{"5-2", 0, 59},
+		{"*/0", 0, 59},
+		{"*/-1", 0, 59},
+		{"a", 0, 59},
+		{"1-b", 0, 59},
+		{"", 0, 59},
+		{"1,,2", 0, 59},
+	}
+
+	for _, test := range tests {
+		if _, err := parseCronField(test.field, test.min, test.max); err == nil {
+			t.Errorf("%s in %d-%d: no error", test.field, test.min, test.max)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"30s",
+		"0 4 * *",
+		"0 4 * * * *",
+		"@monthly",
+		"61 * * * *",
+		"0 24 * * *",
+		"0 0 * 13 *",
+		"0 0 * * 8",
+		"0 0 30 2 *",
+		"0 0 31 4,6,9,11 *",
+		"tomorrow",
+	} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("%q: no error", spec)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	// A Saturday
+	after := time.Date(2026, 10, 17, 10, 20, 30, 0, time.UTC)
+
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"6h", after.Add(6 * time.Hour)},
+		{"90m", after.Add(90 * time.Minute)},
+		{"@hourly", time.Date(2026, 10, 17, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 10, 17, 10, 30, 0, 0, time.UTC)},
+		{"20 10 * * *", time.Date(2026, 10, 18, 10, 20, 0, 0, time.UTC)},
+		{"21 10 * * *", time.Date(2026, 10, 17, 10, 21, 0, 0, time.UTC)},
+		{"30 4 * * 1-5", time.Date(2026, 10, 19, 4, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 3 1 * *", time.Date(2026, 11, 1, 3, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2026, 10, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 1 *", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 29 2 *", time.Date(2028, 2, 29, 12, 0, 0, 0, time.UTC)},
+		// Day of month and weekday both set: either matches, as in cron
+		{"0 8 25 * 1", time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		schedule, err := ParseSchedule(test.spec)
+		if err != nil {
+			t.Errorf("%s: %v", test.spec, err)
+			continue
+		}
+
+		if got := schedule.Next(after); !got.Equal(test.want) {
+			t.Errorf("%s: next %v, want %v", test.spec, got, test.want)
+		}
+	}
+}
+
+func TestParseScheduleEmpty(t *testing.T) {
+	schedule, err := ParseSchedule("  ")
+	if err != nil || schedule != nil {
+		t.Errorf("empty spec: %v, %v, want no schedule", schedule, err)
+	}
+}
@@ -0,0 +1,63 @@
+package management
+
+import (
+	"livestream-companion/stream"
+	"sort"
+	"strconv"
+)
+
+// StreamSession is a client of a running stream along with the names of the
+// channel and playlist it is watching.
+type StreamSession struct {
+	stream.ClientInfo
+	ChannelName  string
+	PlaylistName string
+}
+
+// GetStreamSessions returns every client currently watching a stream, oldest first.
+func GetStreamSessions() ([]StreamSession, error) {
+	clients := stream.Clients()
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].StartedAt.Before(clients[j].StartedAt)
+	})
+
+	var channelIDs []int
+	var playlistIDs []uint
+	for _, client := range clients {
+		if id, err := strconv.Atoi(client.ChannelID); err == nil {
+			channelIDs = append(channelIDs, id)
+		}
+		playlistIDs = append(playlistIDs, client.PlaylistID)
+	}
+
+	channelNames := make(map[string]string)
+	playlistNames := make(map[uint]string)
+	if len(clients) > 0 {
+		var channels []Channel
+		if err := DB.Select("id", "name").Find(&channels, channelIDs).Error; err != nil {
+			return nil, err
+		}
+		for _, channel := range channels {
+			channelNames[strconv.Itoa(channel.ID)] = channel.Name
+		}
+
+		var playlists []Playlist
+		if err := DB.Select("id", "description").Find(&playlists, playlistIDs).Error; err != nil {
+			return nil, err
+		}
+		for _, playlist := range playlists {
+			playlistNames[playlist.ID] = playlist.Description
+		}
+	}
+
+	result := make([]StreamSession, 0, len(clients))
+	for _, client := range clients {
+		result = append(result, StreamSession{
+			ClientInfo:   client,
+			ChannelName:  channelNames[client.ChannelID],
+			PlaylistName: playlistNames[client.PlaylistID],
+		})
+	}
+
+	return result, nil
+}
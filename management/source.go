@@ -0,0 +1,139 @@
+package management
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Source is where the live categories and channels of a playlist come from.
+// Categories and channels are returned the way the Xtream API describes
+// them, channels with their StreamURL already set.
+type Source interface {
+	// UserInfo returns the account details reported by the provider, if any
+	UserInfo() (UserInfo, error)
+	Categories() ([]Category, error)
+	Channels() ([]Channel, error)
+}
+
+// NewSource returns the source to import the playlist from.
+func NewSource(playlist *Playlist) Source {
+	if playlist.Type == "m3u" {
+		return &m3uSource{playlist: playlist}
+	}
+	return &xtreamSource{playlist: playlist}
+}
+
+type xtreamSource struct {
+	playlist *Playlist
+	info     *XtreamInfo
+}
+
+func (s *xtreamSource) UserInfo() (UserInfo, error) {
+	if s.info == nil {
+		info, err := GetXtreamServerInfo(s.playlist)
+		if err != nil {
+			return UserInfo{}, err
+		}
+		s.info = &info
+	}
+	return s.info.UserInfo, nil
+}
+
+func (s *xtreamSource) Categories() ([]Category, error) {
+	var categories []Category
+	err := xtreamAction(s.playlist, "get_live_categories", nil, &categories)
+	return categories, err
+}
+
+func (s *xtreamSource) Channels() ([]Channel, error) {
+	userInfo, err := s.UserInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	var channels []Channel
+	if err := xtreamAction(s.playlist, "get_live_streams", nil, &channels); err != nil {
+		return nil, err
+	}
+
+	streamFormat := liveStreamFormat(userInfo)
+	for i := range channels {
+		channels[i].StreamURL = fmt.Sprintf("%s/live/%s/%s/%d.%s", s.playlist.Server, s.playlist.Username,
+			s.playlist.Password, channels[i].StreamID, streamFormat)
+	}
+
+	return channels, nil
+}
+
+// liveStreamFormat picks ts when the account allows it, m3u8 otherwise.
+func liveStreamFormat(userInfo UserInfo) string {
+	streamFormat := "m3u8"
+	if len(userInfo.AllowedOutputFormats) > 0 {
+		allowedFormats := "," + strings.Join(userInfo.AllowedOutputFormats, ",") + ","
+		if strings.Contains(allowedFormats, ",ts,") {
+			streamFormat = "ts"
+		} else if !strings.Contains(allowedFormats, ",m3u8,") {
+			streamFormat = userInfo.AllowedOutputFormats[0]
+		}
+	}
+	return streamFormat
+}
+
+type m3uSource struct {
+	playlist *Playlist
+	entries  []M3uEntry
+	loaded   bool
+}
+
+func (s *m3uSource) UserInfo() (UserInfo, error) {
+	return UserInfo{}, nil
+}
+
+// load reads the playlist once for both categories and channels.
+func (s *m3uSource) load() ([]M3uEntry, error) {
+	if !s.loaded {
+		entries, err := getM3uEntries(s.playlist)
+		if err != nil {
+			return nil, err
+		}
+		s.entries = entries
+		s.loaded = true
+	}
+	return s.entries, nil
+}
+
+func (s *m3uSource) Categories() ([]Category, error) {
+	entries, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	// Categories in the order they first show up
+	seen := make(map[string]bool)
+	var categories []Category
+	for i := range entries {
+		group := m3uGroup(&entries[i])
+		if seen[group] {
+			continue
+		}
+		seen[group] = true
+
+		categories = append(categories, Category{ExternalID: m3uCategoryID(group), CategoryName: group})
+	}
+
+	return categories, nil
+}
+
+func (s *m3uSource) Channels() ([]Channel, error) {
+	entries, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	channels := make([]Channel, 0, len(entries))
+	for i := range entries {
+		channels = append(channels, m3uChannel(&entries[i], len(channels)+1))
+	}
+
+	return channels, nil
+}
@@ -0,0 +1,525 @@
+package management
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	VodMovie  = "movie"
+	VodSeries = "series"
+)
+
+// Series whose episodes were fetched more recently than this are not asked again.
+const episodesMaxAge = 12 * time.Hour
+
+// xtreamAction calls an action of the Xtream player API and decodes the JSON
+// answer into v.
+func xtreamAction(playlist *Playlist, action string, params url.Values, v interface{}) error {
+	query := url.Values{}
+	query.Set("username", playlist.Username)
+	query.Set("password", playlist.Password)
+	query.Set("action", action)
+	for key, values := range params {
+		query[key] = values
+	}
+
+	response, err := http.Get(fmt.Sprintf("%s/player_api.php?%s", playlist.Server, query.Encode()))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", action, response.Status)
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", action, err)
+	}
+
+	return nil
+}
+
+// ImportVod imports the movie and series catalogues of an Xtream playlist.
+// Episodes are only fetched for series in active categories, asking the
+// provider for every series would take hours on big catalogues.
+func ImportVod(playlist *Playlist) error {
+	if playlist.Type != "xcode" {
+		return nil
+	}
+
+	startTime := time.Now()
+
+	movieCategories, err := importVodCategories(playlist, VodMovie, "get_vod_categories")
+	if err != nil {
+		return err
+	}
+	if err := importMovies(playlist, movieCategories); err != nil {
+		return err
+	}
+
+	seriesCategories, err := importVodCategories(playlist, VodSeries, "get_series_categories")
+	if err != nil {
+		return err
+	}
+	if err := importSeries(playlist, seriesCategories); err != nil {
+		return err
+	}
+
+	// Whatever the provider doesn't list anymore is gone
+	DB.Where("playlist_id = ? AND updated_at < ?", playlist.ID, startTime).Delete(&VodCategory{})
+	DB.Where("playlist_id = ? AND updated_at < ?", playlist.ID, startTime).Delete(&Movie{})
+	DB.Where("series_id IN (SELECT id FROM series WHERE playlist_id = ? AND updated_at < ?)", playlist.ID, startTime).Delete(&Episode{})
+	DB.Where("playlist_id = ? AND updated_at < ?", playlist.ID, startTime).Delete(&Series{})
+
+	var series []Series
+	result := DB.Joins("JOIN vod_categories ON vod_categories.id = series.vod_category_id").
+		Where("series.playlist_id = ? AND vod_categories.active = ?", playlist.ID, true).
+		Find(&series)
+	if result.Error != nil {
+		return result.Error
+	}
+	for i := range series {
+		if err := series[i].ImportEpisodes(playlist); err != nil {
+			log.Printf("Failed to import episodes of series %d: %v", series[i].ID, err)
+		}
+	}
+
+	log.Printf("Imported VOD of playlist %d in %s", playlist.ID, time.Since(startTime))
+	return nil
+}
+
+// importVodCategories creates or updates the categories of a kind and returns
+// them keyed by their provider id.
+func importVodCategories(playlist *Playlist, kind string, action string) (map[string]*VodCategory, error) {
+	var response []VodCategory
+	if err := xtreamAction(playlist, action, nil, &response); err != nil {
+		return nil, err
+	}
+
+	var existing []VodCategory
+	if err := DB.Where("playlist_id = ? AND kind = ?", playlist.ID, kind).Find(&existing).Error; err != nil {
+		return nil, err
+	}
+	categories := make(map[string]*VodCategory, len(existing))
+	for i := range existing {
+		categories[existing[i].ExternalID] = &existing[i]
+	}
+
+	var categoriesToCreate []*VodCategory
+	for i, category := range response {
+		dbCategory, ok := categories[category.ExternalID]
+		if !ok {
+			dbCategory = &VodCategory{
+				Kind:       kind,
+				ExternalID: category.ExternalID,
+				PlaylistID: playlist.ID,
+			}
+			categories[category.ExternalID] = dbCategory
+			categoriesToCreate = append(categoriesToCreate, dbCategory)
+		}
+		dbCategory.CategoryName = category.CategoryName
+		dbCategory.Num = i
+
+		if ok {
+			if err := DB.Save(dbCategory).Error; err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(categoriesToCreate) > 0 {
+		if err := DB.CreateInBatches(categoriesToCreate, 500).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	return categories, nil
+}
+
+func importMovies(playlist *Playlist, categories map[string]*VodCategory) error {
+	var response []Movie
+	if err := xtreamAction(playlist, "get_vod_streams", nil, &response); err != nil {
+		return err
+	}
+
+	var existing []Movie
+	if err := DB.Where("playlist_id = ?", playlist.ID).Find(&existing).Error; err != nil {
+		return err
+	}
+	movies := make(map[FlexInt]*Movie, len(existing))
+	for i := range existing {
+		movies[existing[i].StreamID] = &existing[i]
+	}
+
+	var moviesToCreate []*Movie
+	var moviesToUpdate []*Movie
+	seen := make(map[FlexInt]bool)
+	for i, movie := range response {
+		category, ok := categories[movie.ExternalCategoryID]
+		if !ok {
+			continue
+		}
+
+		// Providers sometimes list the same entry twice
+		if seen[movie.StreamID] {
+			continue
+		}
+		seen[movie.StreamID] = true
+
+		dbMovie, ok := movies[movie.StreamID]
+		if ok {
+			moviesToUpdate = append(moviesToUpdate, dbMovie)
+		} else {
+			dbMovie = &Movie{PlaylistID: playlist.ID, StreamID: movie.StreamID}
+			moviesToCreate = append(moviesToCreate, dbMovie)
+		}
+
+		extension := movie.ContainerExtension
+		if extension == "" {
+			extension = "mp4"
+		}
+
+		dbMovie.Num = i
+		dbMovie.Name = movie.Name
+		dbMovie.VodCategoryID = category.ID
+		dbMovie.ExternalCategoryID = movie.ExternalCategoryID
+		dbMovie.StreamIcon = movie.StreamIcon
+		dbMovie.Added = movie.Added
+		dbMovie.ContainerExtension = extension
+		dbMovie.StreamURL = fmt.Sprintf("%s/movie/%s/%s/%d.%s", playlist.Server, playlist.Username, playlist.Password, movie.StreamID, extension)
+	}
+
+	return saveInBatches(moviesToCreate, moviesToUpdate)
+}
+
+func importSeries(playlist *Playlist, categories map[string]*VodCategory) error {
+	var response []Series
+	if err := xtreamAction(playlist, "get_series", nil, &response); err != nil {
+		return err
+	}
+
+	var existing []Series
+	if err := DB.Where("playlist_id = ?", playlist.ID).Find(&existing).Error; err != nil {
+		return err
+	}
+	series := make(map[FlexInt]*Series, len(existing))
+	for i := range existing {
+		series[existing[i].SeriesID] = &existing[i]
+	}
+
+	var seriesToCreate []*Series
+	var seriesToUpdate []*Series
+	seen := make(map[FlexInt]bool)
+	for i, show := range response {
+		category, ok := categories[show.ExternalCategoryID]
+		if !ok {
+			continue
+		}
+
+		// Providers sometimes list the same entry twice
+		if seen[show.SeriesID] {
+			continue
+		}
+		seen[show.SeriesID] = true
+
+		dbSeries, ok := series[show.SeriesID]
+		if ok {
+			seriesToUpdate = append(seriesToUpdate, dbSeries)
+		} else {
+			dbSeries = &Series{PlaylistID: playlist.ID, SeriesID: show.SeriesID}
+			seriesToCreate = append(seriesToCreate, dbSeries)
+		}
+
+		dbSeries.Num = i
+		dbSeries.Name = show.Name
+		dbSeries.VodCategoryID = category.ID
+		dbSeries.ExternalCategoryID = show.ExternalCategoryID
+		dbSeries.Cover = show.Cover
+		dbSeries.Plot = show.Plot
+		dbSeries.Genre = show.Genre
+		dbSeries.ReleaseDate = show.ReleaseDate
+	}
+
+	return saveInBatches(seriesToCreate, seriesToUpdate)
+}
+
+// saveInBatches creates the new rows and saves the changed ones in a single
+// transaction, much faster on SQLite than one implicit transaction per row.
+func saveInBatches[T any](toCreate []*T, toUpdate []*T) error {
+	tx := DB.Begin()
+	if len(toCreate) > 0 {
+		if err := tx.CreateInBatches(toCreate, 500).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, row := range toUpdate {
+		if err := tx.Save(row).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit().Error
+}
+
+type seriesInfo struct {
+	Episodes json.RawMessage `json:"episodes"`
+}
+
+// ImportEpisodes updates the episodes of the series from the ones listed by
+// the provider, unless they were fetched recently.
+func (s *Series) ImportEpisodes(playlist *Playlist) error {
+	if time.Since(s.EpisodesUpdatedAt) < episodesMaxAge {
+		return nil
+	}
+
+	var info seriesInfo
+	params := url.Values{"series_id": {strconv.Itoa(int(s.SeriesID))}}
+	if err := xtreamAction(playlist, "get_series_info", params, &info); err != nil {
+		return err
+	}
+
+	// Episodes come grouped by season, an empty list when there are none
+	var seasons map[string][]Episode
+	if err := json.Unmarshal(info.Episodes, &seasons); err != nil {
+		seasons = nil
+	}
+
+	var episodes []Episode
+	for season, seasonEpisodes := range seasons {
+		seasonNum, _ := strconv.Atoi(season)
+		for _, episode := range seasonEpisodes {
+			extension := episode.ContainerExtension
+			if extension == "" {
+				extension = "mp4"
+			}
+			if episode.Season == 0 {
+				episode.Season = FlexInt(seasonNum)
+			}
+
+			episodes = append(episodes, Episode{
+				SeriesID:           s.ID,
+				ExternalID:         episode.ExternalID,
+				Title:              episode.Title,
+				Season:             episode.Season,
+				EpisodeNum:         episode.EpisodeNum,
+				ContainerExtension: extension,
+				StreamURL:          fmt.Sprintf("%s/series/%s/%s/%s.%s", playlist.Server, playlist.Username, playlist.Password, episode.ExternalID, extension),
+			})
+		}
+	}
+	sort.Slice(episodes, func(i, j int) bool {
+		if episodes[i].Season != episodes[j].Season {
+			return episodes[i].Season < episodes[j].Season
+		}
+		return episodes[i].EpisodeNum < episodes[j].EpisodeNum
+	})
+
+	s.EpisodesUpdatedAt = time.Now()
+	return s.saveEpisodes(episodes)
+}
+
+// saveEpisodes updates the episodes of the series the provider still lists,
+// matched by their provider id, adds the new ones and deletes the others.
+// Known episodes keep their ID, which the exported .strm files point to.
+func (s *Series) saveEpisodes(episodes []Episode) error {
+	var existing []Episode
+	if err := DB.Where("series_id = ?", s.ID).Find(&existing).Error; err != nil {
+		return err
+	}
+	known := make(map[string]*Episode, len(existing))
+	for i := range existing {
+		known[existing[i].ExternalID] = &existing[i]
+	}
+
+	var episodesToCreate []*Episode
+	var episodesToUpdate []*Episode
+	keptIDs := []uint{0}
+	seen := make(map[string]bool)
+	for i := range episodes {
+		episode := &episodes[i]
+
+		// Providers sometimes list the same episode twice
+		if seen[episode.ExternalID] {
+			continue
+		}
+		seen[episode.ExternalID] = true
+
+		dbEpisode, ok := known[episode.ExternalID]
+		if !ok {
+			episodesToCreate = append(episodesToCreate, episode)
+			continue
+		}
+
+		episode.ID = dbEpisode.ID
+		episode.CreatedAt = dbEpisode.CreatedAt
+		episodesToUpdate = append(episodesToUpdate, episode)
+		keptIDs = append(keptIDs, episode.ID)
+	}
+
+	tx := DB.Begin()
+	if err := tx.Where("series_id = ? AND id NOT IN ?", s.ID, keptIDs).Delete(&Episode{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if len(episodesToCreate) > 0 {
+		if err := tx.CreateInBatches(episodesToCreate, 500).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, episode := range episodesToUpdate {
+		if err := tx.Save(episode).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Model(&Series{}).Where("id = ?", s.ID).Update("EpisodesUpdatedAt", s.EpisodesUpdatedAt).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	s.Episodes = episodes
+	return nil
+}
+
+func (c *VodCategory) Update() error {
+	result := DB.Model(&VodCategory{}).Where("id = ?", c.ID).UpdateColumns(map[string]interface{}{
+		"Active":       c.Active,
+		"CategoryName": c.CategoryName,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	return nil
+}
+
+// ImportEpisodes fetches the episodes of every series in the category.
+func (c *VodCategory) ImportEpisodes() error {
+	if c.Kind != VodSeries {
+		return nil
+	}
+
+	playlist, err := GetPlaylistByID(c.PlaylistID)
+	if err != nil {
+		return err
+	}
+
+	series, err := GetSeriesByVodCategoryID(c.ID)
+	if err != nil {
+		return err
+	}
+
+	for i := range series {
+		if err := series[i].ImportEpisodes(playlist); err != nil {
+			log.Printf("Failed to import episodes of series %d: %v", series[i].ID, err)
+		}
+	}
+
+	return nil
+}
+
+func GetVodCategoriesByPlaylistID(playlistID uint, kind string) ([]VodCategory, error) {
+	var categories []VodCategory
+	query := DB.Where("playlist_id = ?", playlistID)
+	if kind != "" {
+		query = query.Where("kind = ?", kind)
+	}
+
+	result := query.Order("kind asc, num asc").Find(&categories)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return categories, nil
+}
+
+func GetVodCategoryByID(id uint) (*VodCategory, error) {
+	var category VodCategory
+	result := DB.First(&category, id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &category, nil
+}
+
+func GetMoviesByVodCategoryID(categoryID uint) ([]Movie, error) {
+	var movies []Movie
+	result := DB.Where("vod_category_id = ?", categoryID).Order("num asc").Find(&movies)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return movies, nil
+}
+
+func GetSeriesByVodCategoryID(categoryID uint) ([]Series, error) {
+	var series []Series
+	result := DB.Where("vod_category_id = ?", categoryID).Order("num asc").Find(&series)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return series, nil
+}
+
+func GetMovieByID(id uint) (*Movie, error) {
+	var movie Movie
+	result := DB.First(&movie, id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &movie, nil
+}
+
+// GetSeriesByID returns the series with its episodes, fetching them from the
+// provider when they were never imported.
+func GetSeriesByID(id uint) (*Series, error) {
+	var series Series
+	result := DB.First(&series, id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if series.EpisodesUpdatedAt.IsZero() {
+		playlist, err := GetPlaylistByID(series.PlaylistID)
+		if err != nil {
+			return nil, err
+		}
+		if err := series.ImportEpisodes(playlist); err != nil {
+			return nil, err
+		}
+	}
+
+	result = DB.Where("series_id = ?", series.ID).Order("season asc, episode_num asc").Find(&series.Episodes)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &series, nil
+}
+
+func GetEpisodeByID(id uint) (*Episode, error) {
+	var episode Episode
+	result := DB.First(&episode, id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &episode, nil
+}
@@ -0,0 +1,68 @@
+package management
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestExportedEpisodeURLsSurviveReimport(t *testing.T) {
+	openTestDB(t)
+
+	category := VodCategory{PlaylistID: 1, Kind: VodSeries, ExternalID: "20", CategoryName: "Shows", Active: true}
+	if err := DB.Create(&category).Error; err != nil {
+		t.Fatal(err)
+	}
+	series := Series{PlaylistID: 1, VodCategoryID: category.ID, SeriesID: 900, Name: "Show"}
+	if err := DB.Create(&series).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	err := series.saveEpisodes([]Episode{
+		{SeriesID: series.ID, ExternalID: "7001", Title: "Pilot", Season: 1, EpisodeNum: 1, ContainerExtension: "mkv"},
+		{SeriesID: series.ID, ExternalID: "7002", Title: "Two", Season: 1, EpisodeNum: 2, ContainerExtension: "mkv"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := vodEntries(1, "http://companion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("%d entries exported, want 2", len(entries))
+	}
+	pilotURL := entries[0].URL
+
+	// The provider renamed the pilot, dropped the second episode and added a third
+	err = series.saveEpisodes([]Episode{
+		{SeriesID: series.ID, ExternalID: "7001", Title: "Pilot (remastered)", Season: 1, EpisodeNum: 1, ContainerExtension: "mkv"},
+		{SeriesID: series.ID, ExternalID: "7003", Title: "Three", Season: 1, EpisodeNum: 3, ContainerExtension: "mkv"},
+		{SeriesID: series.ID, ExternalID: "7003", Title: "Three", Season: 1, EpisodeNum: 3, ContainerExtension: "mkv"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The handler of /vod/episode/<id>.<ext> finds the episode by the ID in the URL
+	base := path.Base(pilotURL)
+	id, err := strconv.Atoi(strings.TrimSuffix(base, path.Ext(base)))
+	if err != nil {
+		t.Fatalf("unexpected URL %s", pilotURL)
+	}
+	episode, err := GetEpisodeByID(uint(id))
+	if err != nil {
+		t.Fatalf("%s no longer resolves: %v", pilotURL, err)
+	}
+	if episode.ExternalID != "7001" || episode.Title != "Pilot (remastered)" {
+		t.Errorf("%s resolves to episode %s %q", pilotURL, episode.ExternalID, episode.Title)
+	}
+
+	var externalIDs []string
+	DB.Model(&Episode{}).Where("series_id = ?", series.ID).Order("external_id").Pluck("external_id", &externalIDs)
+	if strings.Join(externalIDs, ",") != "7001,7003" {
+		t.Errorf("episodes %v after the re-import, want 7001,7003", externalIDs)
+	}
+}
@@ -0,0 +1,147 @@
+package management
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// StrmDir is where the .strm libraries for Jellyfin or Emby are written.
+var StrmDir = "./strm"
+
+// vodEntry is a movie or an episode ready to be exported.
+type vodEntry struct {
+	Group string
+	Name  string
+	Logo  string
+	URL   string
+
+	// Location in the .strm library, relative to the playlist directory
+	Path string
+}
+
+var unsafePathChars = regexp.MustCompile(`[<>:"/\\|?*\x00-\x1f]+`)
+
+func safePathName(name string) string {
+	name = strings.Join(strings.Fields(unsafePathChars.ReplaceAllString(name, " ")), " ")
+	if name == "" {
+		name = "Unknown"
+	}
+	return name
+}
+
+// m3uAttribute makes a value safe to put between the quotes of an attribute.
+func m3uAttribute(value string) string {
+	return strings.NewReplacer(`"`, "'", "\n", " ", "\r", " ").Replace(value)
+}
+
+// vodEntries lists the movies and episodes of the active VOD categories of the
+// playlist, pointing at our own VOD endpoints under baseURL.
+func vodEntries(playlistID uint, baseURL string) ([]vodEntry, error) {
+	categories, err := GetVodCategoriesByPlaylistID(playlistID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []vodEntry
+	for _, category := range categories {
+		if !category.Active {
+			continue
+		}
+
+		if category.Kind == VodMovie {
+			movies, err := GetMoviesByVodCategoryID(category.ID)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, movie := range movies {
+				name := safePathName(movie.Name)
+				entries = append(entries, vodEntry{
+					Group: category.CategoryName,
+					Name:  movie.Name,
+					Logo:  movie.StreamIcon,
+					URL:   fmt.Sprintf("%s/vod/movie/%d.%s", baseURL, movie.ID, movie.ContainerExtension),
+					Path:  filepath.Join("Movies", name, name+".strm"),
+				})
+			}
+			continue
+		}
+
+		series, err := GetSeriesByVodCategoryID(category.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, show := range series {
+			var episodes []Episode
+			if err := DB.Where("series_id = ?", show.ID).Order("season asc, episode_num asc").Find(&episodes).Error; err != nil {
+				return nil, err
+			}
+
+			showName := safePathName(show.Name)
+			for _, episode := range episodes {
+				episodeName := fmt.Sprintf("%s S%02dE%02d", show.Name, episode.Season, episode.EpisodeNum)
+				entries = append(entries, vodEntry{
+					Group: show.Name,
+					Name:  episodeName,
+					Logo:  show.Cover,
+					URL:   fmt.Sprintf("%s/vod/episode/%d.%s", baseURL, episode.ID, episode.ContainerExtension),
+					Path: filepath.Join("Shows", showName, fmt.Sprintf("Season %02d", episode.Season),
+						safePathName(episodeName)+".strm"),
+				})
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// ExportVodM3u returns the active movies and episodes of the playlist as an
+// m3u playlist.
+func ExportVodM3u(playlistID uint, baseURL string) ([]byte, error) {
+	entries, err := vodEntries(playlistID, baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	for _, entry := range entries {
+		fmt.Fprintf(&buf, "#EXTINF:-1 tvg-name=\"%s\" tvg-logo=\"%s\" group-title=\"%s\",%s\n%s\n",
+			m3uAttribute(entry.Name), m3uAttribute(entry.Logo), m3uAttribute(entry.Group), m3uAttribute(entry.Name), entry.URL)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// ExportVodStrm writes a .strm file per active movie and episode of the
+// playlist, laid out the way media servers expect a library. Files from a
+// previous export are removed first. Returns the number of files written.
+func ExportVodStrm(playlistID uint, baseURL string) (int, error) {
+	entries, err := vodEntries(playlistID, baseURL)
+	if err != nil {
+		return 0, err
+	}
+
+	dir := filepath.Join(StrmDir, strconv.Itoa(int(playlistID)))
+	if err := os.RemoveAll(dir); err != nil {
+		return 0, err
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return 0, err
+		}
+		if err := os.WriteFile(path, []byte(entry.URL+"\n"), 0644); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(entries), nil
+}
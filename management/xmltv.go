@@ -5,24 +5,180 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"gorm.io/gorm"
 )
 
+// Elements of a programme are in the order of the XMLTV DTD, players
+// validating the guide reject them otherwise.
 type EPGProgramme struct {
-	XMLName        xml.Name `xml:"programme"`
-	Start          string   `xml:"start,attr"`
-	Stop           string   `xml:"stop,attr"`
-	StartTimestamp string   `xml:"start_timestamp,attr"`
-	StopTimestamp  string   `xml:"stop_timestamp,attr"`
-	Channel        string   `xml:"channel,attr"`
-	Title          string   `xml:"title"`
-	Desc           string   `xml:"desc"`
-	Items          []XMLAny `xml:",any"`
+	XMLName         xml.Name              `xml:"programme"`
+	Start           string                `xml:"start,attr"`
+	Stop            string                `xml:"stop,attr"`
+	StartTimestamp  string                `xml:"start_timestamp,attr"`
+	StopTimestamp   string                `xml:"stop_timestamp,attr"`
+	Channel         string                `xml:"channel,attr"`
+	Title           string                `xml:"title"`
+	SubTitle        string                `xml:"sub-title,omitempty"`
+	Desc            string                `xml:"desc"`
+	Credits         *XMLTVCredits         `xml:"credits"`
+	Date            string                `xml:"date,omitempty"`
+	Categories      []string              `xml:"category"`
+	Language        string                `xml:"language,omitempty"`
+	Icon            *XMLTVIcon            `xml:"icon"`
+	EpisodeNums     []XMLTVEpisodeNum     `xml:"episode-num"`
+	PreviouslyShown *XMLTVPreviouslyShown `xml:"previously-shown"`
+	New             *struct{}             `xml:"new"`
+	Rating          *XMLTVRating          `xml:"rating"`
+	CatchupID       string                `xml:"catchup-id,attr,omitempty"`
+	Items           []XMLAny              `xml:",any"`
+}
+
+type XMLTVCredits struct {
+	Directors    []string     `xml:"director" json:",omitempty"`
+	Actors       []XMLTVActor `xml:"actor" json:",omitempty"`
+	Writers      []string     `xml:"writer" json:",omitempty"`
+	Adapters     []string     `xml:"adapter" json:",omitempty"`
+	Producers    []string     `xml:"producer" json:",omitempty"`
+	Composers    []string     `xml:"composer" json:",omitempty"`
+	Editors      []string     `xml:"editor" json:",omitempty"`
+	Presenters   []string     `xml:"presenter" json:",omitempty"`
+	Commentators []string     `xml:"commentator" json:",omitempty"`
+	Guests       []string     `xml:"guest" json:",omitempty"`
+}
+
+type XMLTVActor struct {
+	Role string `xml:"role,attr,omitempty" json:",omitempty"`
+	Name string `xml:",chardata"`
+}
+
+type XMLTVIcon struct {
+	Src string `xml:"src,attr"`
+}
+
+// XMLTVEpisodeNum is an episode number, "0.4." or "S01E05" depending on its
+// system, xmltv_ns or onscreen.
+type XMLTVEpisodeNum struct {
+	System string `xml:"system,attr,omitempty"`
+	Value  string `xml:",chardata"`
+}
+
+type XMLTVPreviouslyShown struct {
+	Start string `xml:"start,attr,omitempty"`
+}
+
+type XMLTVRating struct {
+	System string `xml:"system,attr,omitempty"`
+	Value  string `xml:"value"`
+}
+
+// episodeNum returns the number of the given system, empty if there is none.
+// Numbers without a system are xmltv_ns, as in the DTD.
+func (p *EPGProgramme) episodeNum(system string) string {
+	for _, episodeNum := range p.EpisodeNums {
+		if episodeNum.System == system || (episodeNum.System == "" && system == "xmltv_ns") {
+			return strings.TrimSpace(episodeNum.Value)
+		}
+	}
+	return ""
+}
+
+// programme converts the XMLTV programme to the one stored for a channel.
+func (p *EPGProgramme) programme(channelID int) Programme {
+	programme := Programme{
+		Start:           p.Start,
+		Stop:            p.Stop,
+		StartTimestamp:  p.StartTimestamp,
+		StopTimestamp:   p.StopTimestamp,
+		Channel:         p.Channel,
+		ChannelID:       channelID, // Reference the Channel ID.
+		Title:           p.Title,
+		SubTitle:        p.SubTitle,
+		Desc:            p.Desc,
+		Categories:      p.Categories,
+		EpisodeNum:      p.episodeNum("onscreen"),
+		EpisodeNumXmltv: p.episodeNum("xmltv_ns"),
+		Date:            p.Date,
+		Language:        p.Language,
+		New:             p.New != nil,
+	}
+	if p.Credits != nil {
+		programme.Credits = *p.Credits
+	}
+	if p.Icon != nil {
+		programme.Icon = p.Icon.Src
+	}
+	if p.PreviouslyShown != nil {
+		programme.PreviouslyShown = true
+		programme.PreviouslyShownStart = p.PreviouslyShown.Start
+	}
+	if p.Rating != nil {
+		programme.Rating = p.Rating.Value
+		programme.RatingSystem = p.Rating.System
+	}
+
+	return programme
+}
+
+// EpisodeKey tells episodes of a series apart, empty if the guide doesn't number them.
+func (p *Programme) EpisodeKey() string {
+	if p.EpisodeNum != "" {
+		return p.EpisodeNum
+	}
+	return p.EpisodeNumXmltv
+}
+
+// epgProgramme converts a stored programme back to XMLTV.
+func (p *Programme) epgProgramme(channel string) EPGProgramme {
+	epgProgramme := EPGProgramme{
+		Start:          p.Start,
+		Stop:           p.Stop,
+		StartTimestamp: p.StartTimestamp,
+		StopTimestamp:  p.StopTimestamp,
+		Channel:        channel,
+		Title:          p.Title,
+		SubTitle:       p.SubTitle,
+		Desc:           p.Desc,
+		Date:           p.Date,
+		Categories:     p.Categories,
+		Language:       p.Language,
+	}
+
+	if !p.Credits.empty() {
+		credits := p.Credits
+		epgProgramme.Credits = &credits
+	}
+	if p.Icon != "" {
+		epgProgramme.Icon = &XMLTVIcon{Src: p.Icon}
+	}
+	if p.EpisodeNumXmltv != "" {
+		epgProgramme.EpisodeNums = append(epgProgramme.EpisodeNums, XMLTVEpisodeNum{System: "xmltv_ns", Value: p.EpisodeNumXmltv})
+	}
+	if p.EpisodeNum != "" {
+		epgProgramme.EpisodeNums = append(epgProgramme.EpisodeNums, XMLTVEpisodeNum{System: "onscreen", Value: p.EpisodeNum})
+	}
+	if p.PreviouslyShown {
+		epgProgramme.PreviouslyShown = &XMLTVPreviouslyShown{Start: p.PreviouslyShownStart}
+	}
+	if p.New {
+		epgProgramme.New = &struct{}{}
+	}
+	if p.Rating != "" {
+		epgProgramme.Rating = &XMLTVRating{System: p.RatingSystem, Value: p.Rating}
+	}
+
+	return epgProgramme
+}
+
+func (c *XMLTVCredits) empty() bool {
+	return len(c.Directors) == 0 && len(c.Actors) == 0 && len(c.Writers) == 0 && len(c.Adapters) == 0 &&
+		len(c.Producers) == 0 && len(c.Composers) == 0 && len(c.Editors) == 0 && len(c.Presenters) == 0 &&
+		len(c.Commentators) == 0 && len(c.Guests) == 0
 }
 
 type Tv struct {
@@ -73,12 +229,53 @@ func UpdateDBEPG(checkLastProcessed bool) {
 		}
 	}
 
+	// EPG sources without a schedule of their own are refreshed along
+	sources, err := GetEpgSources()
+	if err != nil {
+		log.Printf("Failed to fetch EPG sources: %v", err)
+	}
+	for _, source := range sources {
+		if source.RefreshSchedule != "" {
+			continue
+		}
+		if checkLastProcessed && time.Since(source.LastRefreshAt).Hours() < 12 {
+			log.Printf("EPG source %v was already processed less than 12 hours ago. Skipping...", source.ID)
+			continue
+		}
+
+		if err := source.Refresh(); err != nil {
+			log.Printf("%v", err)
+		}
+	}
+
 	vaccum()
 }
 
 var mutexEPG = &sync.Mutex{}
 
 func UpdatePlaylistEPG(playlist Playlist) error {
+	return updatePlaylistEPG(playlist, nil)
+}
+
+// setEpgStatus saves the EPG status of the playlist, and when it was last
+// processed once it is done. Only these columns are written, the playlist
+// may have been changed by an import meanwhile.
+func (p *Playlist) setEpgStatus(status int) error {
+	p.EpgStatus = status
+	columns := map[string]interface{}{
+		"EpgStatus": p.EpgStatus,
+	}
+	if status == 2 {
+		p.EPGLastProcessedAt = time.Now()
+		columns["EPGLastProcessedAt"] = p.EPGLastProcessedAt
+	}
+
+	return DB.Model(&Playlist{}).Where("id = ?", p.ID).UpdateColumns(columns).Error
+}
+
+// updatePlaylistEPG reports its progress to the job of the playlist import,
+// if any.
+func updatePlaylistEPG(playlist Playlist, job *ImportJob) error {
 	mutexEPG.Lock()
 	defer mutexEPG.Unlock()
 
@@ -88,13 +285,13 @@ func UpdatePlaylistEPG(playlist Playlist) error {
 	if err == nil && xtreamInfo.UserInfo.ExpirationDate != "" {
 		playlist.ExpiresAt = xtreamInfo.UserInfo.ExpirationDate
 	}
+	playlist.SetMaxConnections(xtreamInfo.UserInfo)
 	if playlist.ExpiresAt != "" {
 		playlist.Expired = IsDateBeforeCurrent(playlist.ExpiresAt)
-		playlist.Update()
+		playlist.saveAccountInfo()
 	}
 	if err != nil {
-		playlist.EpgStatus = -1
-		DB.Save(&playlist)
+		playlist.setEpgStatus(-1)
 		return fmt.Errorf("failed to update playlist status: %w", err)
 	}
 
@@ -102,135 +299,82 @@ func UpdatePlaylistEPG(playlist Playlist) error {
 		return nil;
 	}
 
-	playlist.EpgStatus = 1
-	if err := DB.Save(&playlist).Error; err != nil {
-		playlist.EpgStatus = -1
-		DB.Save(&playlist)
+	if err := playlist.setEpgStatus(1); err != nil {
+		playlist.setEpgStatus(-1)
 		return fmt.Errorf("failed to update playlist status: %w", err)
 	}
 
-	url := playlist.XmltvURL
-	response, err := http.Get(url)
-	if err != nil {
-		playlist.EpgStatus = -1
-		DB.Save(&playlist)
-		return fmt.Errorf("failed to get HTTP response: %w", err)
-	}
-	defer response.Body.Close()
-
-	data, err := io.ReadAll(response.Body)
-	if err != nil {
-		playlist.EpgStatus = -1
-		DB.Save(&playlist)
-		return fmt.Errorf("failed to read response body: %w", err)
-	}
-
-	epgFilePath := fmt.Sprintf("epg/%v.xml", playlist.ID)
-	err = os.WriteFile(epgFilePath, data, 0644)
-	if err != nil {
-		playlist.EpgStatus = -1
-		DB.Save(&playlist)
-		return fmt.Errorf("failed to write to EPG file: %w", err)
+	epgFilePath := guide{playlistID: playlist.ID}.filePath()
+	if err := downloadXMLTV(playlist.XmltvURL, epgFilePath); err != nil {
+		playlist.setEpgStatus(-1)
+		return fmt.Errorf("failed to download EPG: %w", err)
 	}
 
 	log.Printf("EPG for playlist %v downloaded successfully.", playlist.ID)
 
-	// Read and modify XML
-	tv := &Tv{}
-	err = xml.Unmarshal(data, tv)
-	if err != nil {
-		playlist.EpgStatus = -1
-		DB.Save(&playlist)
-		return fmt.Errorf("failed to unmarshal XML data: %w", err)
-	}
+	job.setPhase(ImportPhaseEpg, 0)
 
-	// Raw SQL to delete all Programme entries where the channel_id matches a EpgChannelID in Channels for a given playlist_id
-	if err := DB.Exec("DELETE FROM programmes WHERE channel_id IN (SELECT id FROM channels WHERE category_id IN (SELECT id FROM categories WHERE playlist_id = ?))", playlist.ID).Error; err != nil {
-		playlist.EpgStatus = -1
-		DB.Save(&playlist)
-		return fmt.Errorf("failed to delete programmes from DB: %w", err)
+	if err := (guide{playlistID: playlist.ID}).importFile(epgFilePath, job); err != nil {
+		playlist.setEpgStatus(-1)
+		return err
 	}
 
-	// Loop through each channel in XML EPG
-	for _, epgChannel := range tv.Channels {
-		// Find corresponding channels in the database
-		dbChannels, err := GetChannelsByEpgIdAndPlaylistId(epgChannel.ID, playlist.ID)
-		if err != nil {
-			log.Println("Could not find database channel for EPG ID", epgChannel.ID)
-			continue
-		}
+	if err := playlist.setEpgStatus(2); err != nil {
+		playlist.setEpgStatus(-1)
+		return fmt.Errorf("failed to save playlist: %w", err)
+	}
 
-		newProgrammes := []Programme{} // Slice to hold new programmes
-
-		// For each database channel
-		for _, dbChannel := range dbChannels {
-			// Loop through each EPG programme
-			for _, epgProgramme := range tv.Programmes {
-				// If the Channel ID of the programme matches the ID of the epgChannel, create a new Programme
-				if epgProgramme.Channel == epgChannel.ID {
-					newProgramme := Programme{
-						Start:          epgProgramme.Start,
-						Stop:           epgProgramme.Stop,
-						StartTimestamp: epgProgramme.StartTimestamp,
-						StopTimestamp:  epgProgramme.StopTimestamp,
-						Channel:        epgProgramme.Channel,
-						ChannelID:      dbChannel.ID, // Reference the Channel ID.
-						Title:          epgProgramme.Title,
-						Desc:           epgProgramme.Desc,
-					}
-
-					// Add to the slice of newProgrammes
-					newProgrammes = append(newProgrammes, newProgramme)
-				}
-			}
-		}
+	log.Printf("Playlist %v processed successfully.", playlist.ID)
 
-		chunkSize := 500 // Adjust this number based on your data
-		for i := 0; i < len(newProgrammes); i += chunkSize {
-			end := i + chunkSize
+	// The new guide may have episodes the series rules want
+	ApplyRecordingRules()
 
-			// Check if end is out of range
-			if end > len(newProgrammes) {
-				end = len(newProgrammes)
-			}
+	return nil
+}
 
-			// Get a chunk of new programmes
-			chunk := newProgrammes[i:end]
+// Programmes inserted per statement
+const programmeBatchSize = 500
 
-			// Prepare SQL statement and values
-			sql := "INSERT INTO `programmes` (`created_at`,`updated_at`,`deleted_at`,`start`,`stop`,`start_timestamp`,`stop_timestamp`,`channel`,`channel_id`,`title`,`desc`) VALUES "
-			values := []interface{}{}
+// downloadXMLTV saves the guide at url to path, decompressing it if it is
+// gzipped, without ever holding it in memory.
+func downloadXMLTV(url string, path string) error {
+	r, err := openLocation(url)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
 
-			// Loop through each programme in chunk
-			for _, programme := range chunk {
-				// Append SQL and values
-				sql += "(?,?,?,?,?,?,?,?,?,?,?),"
-				values = append(values, time.Now(), time.Now(), nil, programme.Start, programme.Stop, programme.StartTimestamp, programme.StopTimestamp, programme.Channel, programme.ChannelID, programme.Title, programme.Desc)
-			}
+	content, err := gunzipped(r)
+	if err != nil {
+		return err
+	}
 
-			// Trim trailing comma
-			sql = strings.TrimSuffix(sql, ",")
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, content); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
 
-			// Execute SQL statement
-			err = DB.Exec(sql, values...).Error
-			if err != nil {
-				// In case of error, rollback the transaction and return from the function
-				log.Printf("Failed to save Programmes: %v", err)
+	return os.Rename(tmpPath, path)
+}
 
-			}
-		}
+func insertProgrammes(tx *gorm.DB, programmes []Programme, job *ImportJob) error {
+	if len(programmes) == 0 {
+		return nil
 	}
 
-	// update the EPGLastProcessedAt field and save the playlist
-	playlist.EPGLastProcessedAt = time.Now()
-	playlist.EpgStatus = 2
-	if err := DB.Save(&playlist).Error; err != nil {
-		playlist.EpgStatus = -1
-		DB.Save(&playlist)
-		return fmt.Errorf("failed to save playlist: %w", err)
+	if err := tx.Create(&programmes).Error; err != nil {
+		return fmt.Errorf("failed to save programmes: %w", err)
 	}
-
-	log.Printf("Playlist %v processed successfully.", playlist.ID)
+	job.update(func(job *ImportJob) { job.ProgrammesInserted += len(programmes) })
 
 	return nil
 }
@@ -242,6 +386,17 @@ func ExportDBEPGToXML() ([]byte, error) {
 		return nil, err
 	}
 
+	// The playlist type tells whether the archive of a channel can be played
+	var playlists []Playlist
+	if err := DB.Find(&playlists).Error; err != nil {
+		log.Printf("Failed to fetch Playlists: %v", err)
+		return nil, err
+	}
+	playlistsByID := make(map[uint]Playlist, len(playlists))
+	for _, playlist := range playlists {
+		playlistsByID[playlist.ID] = playlist
+	}
+
 	xmlChannels := make([]struct {
 		ID             string `xml:"id,attr"`
 		EpgDisplayName string `xml:"display-name"`
@@ -254,6 +409,7 @@ func ExportDBEPGToXML() ([]byte, error) {
 	var xmlProgrammes []EPGProgramme
 
 	for i, ch := range channels {
+		ch.Category.Playlist = playlistsByID[ch.Category.PlaylistID]
 		xmlChannels[i] = struct {
 			ID             string `xml:"id,attr"`
 			EpgDisplayName string `xml:"display-name"`
@@ -270,15 +426,15 @@ func ExportDBEPGToXML() ([]byte, error) {
 		}
 
 		for _, p := range ch.Programmes {
-			xmlProgrammes = append(xmlProgrammes, EPGProgramme{
-				Start:          p.Start,
-				Stop:           p.Stop,
-				StartTimestamp: p.StartTimestamp,
-				StopTimestamp:  p.StopTimestamp,
-				Channel:        strconv.Itoa(ch.HDHRChannelNum),
-				Title:          p.Title,
-				Desc:           p.Desc,
-			})
+			// Past programmes still in the provider archive can be played back
+			catchupID := ""
+			if start, stop, err := p.Times(); err == nil && ch.CatchupAvailable(start) {
+				catchupID = catchupPath(&ch, start, stop)
+			}
+
+			xmlProgramme := p.epgProgramme(strconv.Itoa(ch.HDHRChannelNum))
+			xmlProgramme.CatchupID = catchupID
+			xmlProgrammes = append(xmlProgrammes, xmlProgramme)
 		}
 	}
 
@@ -296,3 +452,33 @@ func ExportDBEPGToXML() ([]byte, error) {
 	log.Println("EPG database exported successfully.")
 	return data, nil
 }
+
+// parseXMLTVTime parses an XMLTV date like "20231018203000 +0200". The offset
+// is optional, UTC is assumed without it.
+func parseXMLTVTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if len(value) > len("20060102150405") {
+		return time.Parse("20060102150405 -0700", value)
+	}
+	return time.Parse("20060102150405", value)
+}
+
+// Times returns when the programme starts and stops, from the XMLTV dates or
+// the unix timestamps some providers add.
+func (p *Programme) Times() (time.Time, time.Time, error) {
+	start, err := parseXMLTVTime(p.Start)
+	if err == nil {
+		var stop time.Time
+		if stop, err = parseXMLTVTime(p.Stop); err == nil {
+			return start, stop, nil
+		}
+	}
+
+	startUnix, startErr := strconv.ParseInt(p.StartTimestamp, 10, 64)
+	stopUnix, stopErr := strconv.ParseInt(p.StopTimestamp, 10, 64)
+	if startErr != nil || stopErr != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid programme times: %w", err)
+	}
+
+	return time.Unix(startUnix, 0), time.Unix(stopUnix, 0), nil
+}
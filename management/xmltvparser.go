@@ -0,0 +1,122 @@
+package management
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// EPGChannel is a <channel> of an XMLTV guide.
+type EPGChannel struct {
+	ID           string   `xml:"id,attr"`
+	DisplayNames []string `xml:"display-name"`
+	Icon         struct {
+		Src string `xml:"src,attr"`
+	} `xml:"icon"`
+}
+
+// ParseXMLTV reads an XMLTV guide one element at a time, calling onChannel
+// and onProgramme as they come, so guides of hundreds of megabytes never sit
+// in memory. Either callback can be nil, or stop the parsing by returning an
+// error.
+func ParseXMLTV(r io.Reader, onChannel func(*EPGChannel) error, onProgramme func(*EPGProgramme) error) error {
+	decoder := xml.NewDecoder(r)
+	decoder.CharsetReader = xmltvCharsetReader
+	decoder.Strict = false
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		element, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch element.Name.Local {
+		case "channel":
+			if onChannel == nil {
+				if err := decoder.Skip(); err != nil {
+					return err
+				}
+				continue
+			}
+			var channel EPGChannel
+			if err := decoder.DecodeElement(&channel, &element); err != nil {
+				return err
+			}
+			if err := onChannel(&channel); err != nil {
+				return err
+			}
+
+		case "programme":
+			if onProgramme == nil {
+				if err := decoder.Skip(); err != nil {
+					return err
+				}
+				continue
+			}
+			var programme EPGProgramme
+			if err := decoder.DecodeElement(&programme, &element); err != nil {
+				return err
+			}
+			if err := onProgramme(&programme); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// xmltvCharsetReader accepts the latin-1 guides of some providers besides
+// UTF-8, the only encoding encoding/xml knows.
+func xmltvCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "utf-8", "utf8", "us-ascii", "ascii":
+		return input, nil
+	case "iso-8859-1", "iso8859-1", "latin1", "latin-1", "iso-8859-15", "windows-1252", "cp1252":
+		return &latin1Reader{r: bufio.NewReader(input)}, nil
+	}
+	return nil, fmt.Errorf("unsupported XMLTV encoding %q", charset)
+}
+
+// latin1Reader converts latin-1 bytes to UTF-8.
+type latin1Reader struct {
+	r       *bufio.Reader
+	pending []byte
+}
+
+func (l *latin1Reader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(l.pending) > 0 {
+			copied := copy(p[n:], l.pending)
+			l.pending = l.pending[copied:]
+			n += copied
+			continue
+		}
+
+		b, err := l.r.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+
+		if b < utf8.RuneSelf {
+			p[n] = b
+			n++
+			continue
+		}
+		l.pending = utf8.AppendRune(nil, rune(b))
+	}
+	return n, nil
+}
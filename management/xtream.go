@@ -6,10 +6,8 @@ import (
 	"io"
 	"log"
 	"net/http"
-	"strings"
 	"time"
 
-	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
@@ -19,17 +17,17 @@ type CategoryInfo struct {
 	CategoryName string
 }
 
-func handleError(playlist *Playlist, err error) bool {
+func handleError(playlist *Playlist, job *ImportJob, err error) bool {
 	if err != nil {
 		log.Print(err)
-		playlist.ImportStatus = -1
-		playlist.Update();
+		job.finish(err)
+		playlist.setImportStatus(-1)
 		return true
 	}
 	return false
 }
 
-func ImportXtream(c *gin.Context, ID uint) {
+func ImportPlaylist(ID uint) {
 	log.Printf("Importing playlist %d", ID)
 
 	playlist, err := GetPlaylistByID(ID)
@@ -41,104 +39,39 @@ func ImportXtream(c *gin.Context, ID uint) {
 	newPlaylist := playlist.ImportStatus == 0
 
 	startTime := time.Now()
-	playlist.ImportStatus = 1
-	err = playlist.Update()
+	err = playlist.setImportStatus(1)
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	baseURL := playlist.Server
-	username := playlist.Username
-	password := playlist.Password
-
-	scheme := "http"
-	if forwardedProto := c.GetHeader("X-Forwarded-Proto"); forwardedProto != "" {
-		scheme = forwardedProto
-	} else if c.Request.TLS != nil {
-		scheme = "https"
-	}
-
-	var xtreamInfo XtreamInfo
-	xtreamInfo, err = GetXtreamServerInfo(playlist)
-	if handleError(playlist, err) {
-		return
-	}
-
-	playlist.ExpiresAt = xtreamInfo.UserInfo.ExpirationDate
-	playlist.Expired = IsDateBeforeCurrent(xtreamInfo.UserInfo.ExpirationDate)
-
-	streamFormat := "m3u8"
-	if len(xtreamInfo.UserInfo.AllowedOutputFormats) > 0 {
-		allowedFormats := "," + strings.Join(xtreamInfo.UserInfo.AllowedOutputFormats, ",") + ","
-		if strings.Contains(allowedFormats, ",ts,") {
-			streamFormat = "ts"
-		} else if !strings.Contains(allowedFormats, ",m3u8,") {
-			streamFormat = xtreamInfo.UserInfo.AllowedOutputFormats[0]
-		}
-	}
-
-	var categoryListURL string
-	if playlist.Type == "m3u" {
-		categoryListURL = fmt.Sprintf("%s://%s/api/m3u/categories/%d", scheme, c.Request.Host, ID)
-	} else {
-		categoryListURL = fmt.Sprintf("%s/player_api.php?username=%s&password=%s&action=get_live_categories", baseURL, username, password)
-	}
-
-	categoryListResp, err := http.Get(categoryListURL)
-	if err != nil {
+	if err := playlist.refreshed(startTime); err != nil {
 		log.Print(err)
-		playlist.ImportStatus = -1
-		playlist.Update()
-		return
 	}
-	defer categoryListResp.Body.Close()
 
-	categoriesBody, err := io.ReadAll(categoryListResp.Body)
-	if err != nil {
-		log.Print(err)
-		playlist.ImportStatus = -1
-		playlist.Update()
-		return
-	}
+	job := startImportJob(playlist.ID)
 
-	var categoriesResponse []Category
-	if err := json.Unmarshal(categoriesBody, &categoriesResponse); err != nil {
-		log.Print(err)
-		playlist.ImportStatus = -1
-		playlist.Update()
-		return
-	}
+	source := NewSource(playlist)
 
-	var streamListURL string
-	if playlist.Type == "m3u" {
-		streamListURL = fmt.Sprintf("%s://%s/api/m3u/channels/%d", scheme, c.Request.Host, ID)
-	} else {
-		streamListURL = fmt.Sprintf("%s/player_api.php?username=%s&password=%s&action=get_live_streams", baseURL, username, password)
+	userInfo, err := source.UserInfo()
+	if handleError(playlist, job, err) {
+		return
 	}
 
-	streamListResp, err := http.Get(streamListURL)
-	if err != nil {
+	playlist.ExpiresAt = userInfo.ExpirationDate
+	playlist.Expired = IsDateBeforeCurrent(userInfo.ExpirationDate)
+	playlist.SetMaxConnections(userInfo)
+	if err := playlist.saveAccountInfo(); err != nil {
 		log.Print(err)
-		playlist.ImportStatus = -1
-		playlist.Update()
-		return
 	}
-	defer streamListResp.Body.Close()
 
-	streamsBody, err := io.ReadAll(streamListResp.Body)
-	if err != nil {
-		log.Print(err)
-		playlist.ImportStatus = -1
-		playlist.Update()
+	categoriesResponse, err := source.Categories()
+	if handleError(playlist, job, err) {
 		return
 	}
 
-	var channelsResponse []Channel
-	if err := json.Unmarshal(streamsBody, &channelsResponse); err != nil {
-		log.Print(err)
-		playlist.ImportStatus = -1
-		playlist.Update()
+	channelsResponse, err := source.Channels()
+	if handleError(playlist, job, err) {
 		return
 	}
 
@@ -149,6 +82,7 @@ func ImportXtream(c *gin.Context, ID uint) {
 	var hdhrChannelNum = 1000
 	var batchSize = 500
 
+	job.setPhase(ImportPhaseCategories, len(categoriesResponse))
 	for i, category := range categoriesResponse {
 		var dbCategory Category
 		var err error
@@ -161,6 +95,7 @@ func ImportXtream(c *gin.Context, ID uint) {
 			dbCategory.Num = i
 			dbCategory.PlaylistID = playlist.ID
 			dbCategory.Active = false
+			job.update(func(job *ImportJob) { job.CategoriesCreated++ })
 			categoriesToCreate = append(categoriesToCreate, dbCategory)
 			if len(categoriesToCreate) == batchSize {
 				DB.CreateInBatches(categoriesToCreate, batchSize)
@@ -169,6 +104,7 @@ func ImportXtream(c *gin.Context, ID uint) {
 		} else {
 			dbCategory.CategoryName = category.CategoryName
 			dbCategory.Num = i
+			job.update(func(job *ImportJob) { job.CategoriesUpdated++ })
 			categoriesToUpdate = append(categoriesToUpdate, dbCategory)
 			if len(categoriesToUpdate) == batchSize {
 				for _, category := range categoriesToUpdate {
@@ -177,7 +113,7 @@ func ImportXtream(c *gin.Context, ID uint) {
 				categoriesToUpdate = categoriesToUpdate[:0]
 			}
 		}
-
+		job.update(func(job *ImportJob) { job.Processed++ })
 	}
 
 	// Handle remaining categories
@@ -196,7 +132,10 @@ func ImportXtream(c *gin.Context, ID uint) {
 		log.Fatal(result.Error)
 	}
 
+	job.setPhase(ImportPhaseChannels, len(channelsResponse))
 	for _, channel := range channelsResponse {
+		job.update(func(job *ImportJob) { job.Processed++ })
+
 		var category Category
 		var dbChannel Channel
 		var err error = DB.Model(Category{}).Where("external_id = ? and playlist_id = ?", channel.ExternalCategoryID, playlist.ID).First(&category).Error
@@ -213,15 +152,14 @@ func ImportXtream(c *gin.Context, ID uint) {
 			dbChannel.CategoryID = category.ID
 			dbChannel.ExternalCategoryID = channel.ExternalCategoryID
 			dbChannel.StreamID = channel.StreamID
-			if playlist.Type == "m3u" {
-				dbChannel.StreamURL = channel.StreamURL
-			} else {
-				dbChannel.StreamURL = fmt.Sprintf("%s/live/%s/%s/%d.%s", baseURL, username, password, channel.StreamID, streamFormat)
-			}
+			dbChannel.StreamURL = channel.StreamURL
 			dbChannel.EpgChannelID = channel.EpgChannelID
 			dbChannel.HDHRChannelNum = hdhrChannelNum
 			dbChannel.StreamIcon = channel.StreamIcon
+			dbChannel.TvArchive = channel.TvArchive
+			dbChannel.TvArchiveDuration = channel.TvArchiveDuration
 			dbChannel.Active = true
+			job.update(func(job *ImportJob) { job.ChannelsCreated++ })
 			channelsToCreate = append(channelsToCreate, dbChannel)
 			if len(channelsToCreate) == batchSize {
 				DB.CreateInBatches(channelsToCreate, batchSize)
@@ -234,14 +172,15 @@ func ImportXtream(c *gin.Context, ID uint) {
 			dbChannel.CategoryID = category.ID
 			dbChannel.ExternalCategoryID = channel.ExternalCategoryID
 			dbChannel.StreamID = channel.StreamID
-			if playlist.Type == "m3u" {
-				dbChannel.StreamURL = channel.StreamURL
-			} else {
-				dbChannel.StreamURL = fmt.Sprintf("%s/live/%s/%s/%d.%s", baseURL, username, password, channel.StreamID, streamFormat)
+			dbChannel.StreamURL = channel.StreamURL
+			if !dbChannel.CustomEpg {
+				dbChannel.EpgChannelID = channel.EpgChannelID
 			}
-			dbChannel.EpgChannelID = channel.EpgChannelID
 			dbChannel.HDHRChannelNum = hdhrChannelNum
 			dbChannel.StreamIcon = channel.StreamIcon
+			dbChannel.TvArchive = channel.TvArchive
+			dbChannel.TvArchiveDuration = channel.TvArchiveDuration
+			job.update(func(job *ImportJob) { job.ChannelsUpdated++ })
 			channelsToUpdate = append(channelsToUpdate, dbChannel)
 			if len(channelsToUpdate) == batchSize {
 				for _, channel := range channelsToUpdate {
@@ -260,18 +199,30 @@ func ImportXtream(c *gin.Context, ID uint) {
 		DB.Save(&channel)
 	}
 
-	DB.Delete(&Category{}, "playlist_id = ? and updated_at < ?", ID, startTime)
-	DB.Where("category_id IN (SELECT id FROM categories WHERE playlist_id = ?) AND updated_at < ?", ID, startTime).Delete(&Channel{})
+	// Channels first, they are found through their categories
+	channelsDeleted := DB.Where("category_id IN (SELECT id FROM categories WHERE playlist_id = ?) AND updated_at < ?", ID, startTime).Delete(&Channel{}).RowsAffected
+	categoriesDeleted := DB.Delete(&Category{}, "playlist_id = ? and updated_at < ?", ID, startTime).RowsAffected
+	job.update(func(job *ImportJob) {
+		job.CategoriesDeleted = int(categoriesDeleted)
+		job.ChannelsDeleted = int(channelsDeleted)
+	})
 
 	UpdateHDHRChannelNumForAllChannels()
-	playlist.ImportStatus = 2
-	err = playlist.Update()
+	err = playlist.setImportStatus(2)
 	if err != nil {
 		log.Print(err)
+		job.finish(err)
 		return
 	}
 
-	err = UpdatePlaylistEPG(*playlist)
+	job.setPhase(ImportPhaseVod, 0)
+	if err := ImportVod(playlist); err != nil {
+		log.Printf("Failed to import VOD of playlist %d: %v", playlist.ID, err)
+		job.phaseFailed(ImportPhaseVod, err)
+	}
+
+	err = updatePlaylistEPG(*playlist, job)
+	job.finish(err)
 	if err != nil {
 		log.Print(err)
 		return
@@ -2,6 +2,7 @@ package management
 
 import (
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -46,3 +47,22 @@ func IsDateBeforeCurrent(secondsStr string) (bool) {
 	currentDate := time.Now()
 	return date.Before(currentDate)
 }
+
+// FlexInt is a number that providers send either as a JSON number or as a
+// string, depending on the panel version.
+type FlexInt int
+
+func (i *FlexInt) UnmarshalJSON(data []byte) error {
+	value := strings.Trim(string(data), `"`)
+	if value == "" || value == "null" {
+		*i = 0
+		return nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	*i = FlexInt(n)
+	return nil
+}
@@ -53,6 +53,9 @@ func SetupRouter() *gin.Engine {
 	r.POST("/api/playlist", management.InsertPlaylistHandler)
 	r.PUT("/api/playlist/:id", management.UpdatePlaylistByIDHandler)
 	r.DELETE("/api/playlist/:id", management.DeletePlaylistByIDHandler)
+	r.POST("/api/playlist/:id/m3u", management.UploadM3uHandler)
+	r.GET("/api/playlist/:id/imports", management.GetImportJobsByPlaylistIDHandler)
+	r.GET("/api/playlist/:id/imports/progress", management.GetImportProgressHandler)
 
 	// API endpoint for categories
 	r.GET("/api/categories", management.GetCategoriesHandler)
@@ -73,14 +76,65 @@ func SetupRouter() *gin.Engine {
 	r.GET("/api/channels/epg/:epgId/playlist/:playlistId", management.GetChannelsByEpgIdAndPlaylistIdHandler)
 	r.GET("/api/channels/noEpg", management.GetChannelsWithNoEpgHandler)
 	r.GET("/api/channels/noEpg/:playlistId", management.GetChannelsWithNoEpgByPlaylistIdHandler)
+	r.GET("/api/channels/noEpg/suggestions", management.GetEpgSuggestionsHandler)
+	r.POST("/api/channels/noEpg/suggestions", management.AcceptEpgSuggestionsHandler)
 	r.PUT("/api/channels/hdhr", management.UpdateHDHRChannelNumForAllChannelsHandler)
 	r.GET("/api/categories/:category_id/channels", management.GetChannelsByCategoryIdHandler)
 	r.GET("/api/channel/:id/programmes", management.GetProgrammesByChannelIDHandler)
 
-	r.GET("/api/m3u/categories/:playlistID", management.M3uCategoryHandler)
-	r.GET("/api/m3u/channels/:playlistID", management.M3uChannelHandler)
+	// API endpoints for failover groups, kind is "epg" or "group"
+	r.GET("/api/failover", management.GetFailoverGroupsHandler)
+	r.GET("/api/failover/:kind/:name", management.GetFailoverGroupHandler)
+	r.PUT("/api/failover/:kind/:name", management.UpdateFailoverGroupHandler)
+
+	// API endpoints for transcode profiles
+	r.GET("/api/profiles", management.GetTranscodeProfilesHandler)
+	r.GET("/api/profiles/:id", management.GetTranscodeProfileByIDHandler)
+	r.POST("/api/profiles", management.InsertTranscodeProfileHandler)
+	r.PUT("/api/profiles/:id", management.UpdateTranscodeProfileByIDHandler)
+	r.DELETE("/api/profiles/:id", management.DeleteTranscodeProfileByIDHandler)
+
+	// API endpoints for the clients watching live streams
+	r.GET("/api/sessions", management.GetStreamSessionsHandler)
+	r.DELETE("/api/sessions/:id", management.DeleteStreamSessionHandler)
+
+	// API endpoints for DVR recordings
+	r.GET("/api/recordings", management.GetRecordingsHandler)
+	r.GET("/api/recordings/:id", management.GetRecordingByIDHandler)
+	r.GET("/api/recordings/:id/file", management.GetRecordingFileHandler)
+	r.POST("/api/recordings", management.InsertRecordingHandler)
+	r.PUT("/api/recordings/:id", management.UpdateRecordingByIDHandler)
+	r.DELETE("/api/recordings/:id", management.DeleteRecordingByIDHandler)
+
+	// API endpoints for series recording rules
+	r.GET("/api/recordings/rules", management.GetRecordingRulesHandler)
+	r.GET("/api/recordings/rules/:id", management.GetRecordingRuleByIDHandler)
+	r.POST("/api/recordings/rules", management.InsertRecordingRuleHandler)
+	r.PUT("/api/recordings/rules/:id", management.UpdateRecordingRuleByIDHandler)
+	r.DELETE("/api/recordings/rules/:id", management.DeleteRecordingRuleByIDHandler)
+
+	// API endpoints for EPG sources independent of playlists
+	r.GET("/api/epg/sources", management.GetEpgSourcesHandler)
+	r.GET("/api/epg/sources/:id", management.GetEpgSourceByIDHandler)
+	r.GET("/api/epg/sources/:id/channels", management.GetEpgChannelsBySourceIDHandler)
+	r.POST("/api/epg/sources", management.InsertEpgSourceHandler)
+	r.POST("/api/epg/sources/:id/refresh", management.RefreshEpgSourceHandler)
+	r.PUT("/api/epg/sources/:id", management.UpdateEpgSourceByIDHandler)
+	r.DELETE("/api/epg/sources/:id", management.DeleteEpgSourceByIDHandler)
+
+	// API endpoints for movies and series
+	r.GET("/api/playlists/:playlist_id/vod/categories", management.GetVodCategoriesByPlaylistIDHandler)
+	r.GET("/api/playlists/:playlist_id/vod.m3u", management.GetVodM3uHandler)
+	r.POST("/api/playlists/:playlist_id/vod/strm", management.ExportVodStrmHandler)
+	r.PUT("/api/vod/category/:id", management.UpdateVodCategoryByIDHandler)
+	r.GET("/api/vod/category/:id/movies", management.GetMoviesByVodCategoryIDHandler)
+	r.GET("/api/vod/category/:id/series", management.GetSeriesByVodCategoryIDHandler)
+	r.GET("/api/series/:id", management.GetSeriesByIDHandler)
 
 	r.GET("/hls/*path", management.StreamHandler)
+	r.GET("/stream/:id", management.RestreamingHandler)
+	r.GET("/catchup/:id", management.CatchupHandler)
+	r.GET("/vod/:kind/:id", management.VodHandler)
 	r.GET("/xmltv", management.GetEPG)
 
 	return r
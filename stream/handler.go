@@ -1,248 +1,55 @@
 package stream
 
 import (
-	"bufio"
-	"bytes"
 	"io"
 	"log"
-	"net"
 	"net/http"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"strings"
-	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/grafov/m3u8"
 )
 
-type Stream struct {
-	InputURL string
-	Cmd      *exec.Cmd
-	Buffer   *bytes.Buffer
-	Client   http.ResponseWriter
-}
-
-type reHijackWriter struct {
-	gin.ResponseWriter
-	conn *net.TCPConn
-}
-
-func (w *reHijackWriter) Write(b []byte) (int, error) {
-	n, err := w.conn.Write(b)
-	if err != nil {
-			// Aquí detectas la desconexión REAL
-			return n, err
-	}
-	return n, nil
-}
-
-func HandleTS(c *gin.Context, inputUrl string, id string, webbrowser string) {
+func HandleTS(c *gin.Context, tune Tune) {
 	ctx := c.Request.Context()
 
-	if hj, ok := c.Writer.(http.Hijacker); ok {
-    conn, _, err := hj.Hijack()
-    if err == nil {
-        tcpConn := conn.(*net.TCPConn)
-        tcpConn.SetKeepAlive(true)
-        tcpConn.SetKeepAlivePeriod(5 * time.Second)
-
-        // Volvemos a envolver el writer para seguir usando Gin
-        c.Writer = &reHijackWriter{ResponseWriter: c.Writer, conn: tcpConn}
-    }
+	// Share the ffmpeg process with anyone else watching the same channel
+	subscriber, err := Join(tune)
+	if err != nil {
+		log.Printf("Can't tune channel %s: %v", tune.ChannelID, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
 	}
+	defer subscriber.Close()
 
-	hlsDir := "./tmp"
-	hlsFile := filepath.Join(hlsDir, id+".m3u8")
+	client := Register(subscriber.session, subscriber, c.ClientIP(), c.Request.UserAgent())
+	defer client.Unregister()
 
-	cleanupTsFiles(hlsDir, id)
+	c.Writer.Header().Set("Content-Type", "video/mpeg")
+	c.Writer.WriteHeader(http.StatusOK)
+	c.Writer.Flush()
 
-	// Start the FFMPEG command
+	// The request context ends when the client goes away, even if the
+	// stream has nothing to send meanwhile
 	go func() {
-			select {
-			case <-ctx.Done():
-					log.Println("Client disconnected before starting ffmpeg")
-					return
-			default:
-			}
-
-			var cmd *exec.Cmd
-			if webbrowser == "true" {
-				log.Println("Converting audio for web browser compatibility.")
-				cmd = exec.CommandContext(ctx,
-					"./bin/ffmpeg",
-					"-i",
-					inputUrl,
-					"-c:v", "copy",
-					"-c:a", "libmp3lame",
-					"-f", "hls",
-					"-hls_time", "2",
-					"-hls_list_size", "6",
-					"-sn",
-					"-hls_flags", "delete_segments",
-					"-hls_segment_filename", filepath.Join(hlsDir, id+"-%d.ts"),
-					"-index_correction",
-					"-ignore_io_errors",
-					"-use_timeline", "0",
-					hlsFile,
-				)
-			} else if webbrowser == "lq" {
-				log.Println("Converting to low quality resolution.")
-				cmd = exec.CommandContext(ctx,
-					"./bin/ffmpeg",
-					"-i",
-					inputUrl,
-					"-c:v:0", "libx264",
-					"-c:a:0", "libmp3lame",
-					"-filter_complex", "[0:0]yadif@f1=mode=send_frame:parity=auto:deint=all,scale@f2=width=720:height=574[f2_out0]",
-					"-map", "[f2_out0]",
-					"-map", "0:1",
-					"-sn",
-					"-f", "segment",
-					"-segment_format", "mpegts",
-					"-segment_list", hlsFile,
-					"-segment_list_type", "m3u8",
-					"-segment_time", "00:00:03.000",
-					"-maxrate:v:0", "1640000",
-					"-bufsize:v:0", "1280000",
-					"-sc_threshold:v:0", "0",
-					"-keyint_min:v:0", "75",
-					"-r:v:0", "25",
-					"-pix_fmt:v:0", "yuv420p",
-					"-preset:v:0", "veryfast",
-					"-profile:v:0", "high",
-					"-x264opts:v:0", "subme=0:me_range=4:rc_lookahead=10:partitions=none",
-					"-crf:v:0", "23",
-					"-hls_time", "2",
-					"-hls_list_size", "6",
-					"-sn",
-					"-hls_flags", "delete_segments",
-					"-hls_segment_filename", filepath.Join(hlsDir, id+"-%d.ts"),
-					"-index_correction",
-					"-ignore_io_errors",
-					"-use_timeline", "0",
-					filepath.Join(hlsDir, id+"-%d.ts"),
-				)
-			} else {
-					cmd = exec.CommandContext(ctx,
-					"./bin/ffmpeg",
-					"-i",
-					inputUrl,
-					"-c", "copy",
-					"-f", "hls",
-					"-hls_time", "2",
-					"-hls_list_size", "6",
-					"-sn",
-					"-hls_flags", "delete_segments",
-					"-hls_segment_filename", filepath.Join(hlsDir, id+"-%d.ts"),
-					hlsFile,
-				)
-			}
-
-			if err := cmd.Start(); err != nil {
-				log.Println("FFMPEG process couldn't start:", err)
-				return
-			}
-
-			err := cmd.Wait()
-
-			if err != nil {
-				log.Println("FFMPEG process stopped unexpectedly:", err)
-			}
-
-			select {
-			case <-ctx.Done():
-				log.Println("Client disconnected")
-				cleanupTsFiles(hlsDir, id)
-				return
-			default:
-				// Client is still connected, so we continue the loop and start FFMPEG again.
-			}
+		<-ctx.Done()
+		subscriber.Close()
 	}()
 
 	w := c.Writer
-	w.Header().Set("Content-Type", "video/mpeg")
 
-	// Monitor the HLS folder for new .ts files
+	buf := make([]byte, 64*1024)
 	for {
-		select {
-		case <-ctx.Done():
-			log.Println("Client disconnected")
-			return
-		default:
-			// Read playlist
-			playlist, err := os.ReadFile(hlsFile)
-			if err != nil {
-				time.Sleep(time.Second)
-				continue
-			}
-
-			p, listType, err := m3u8.DecodeFrom(bufio.NewReader(strings.NewReader(string(playlist))), true)
-			if err != nil {
-				log.Printf("Error decoding playlist: %v", err)
-				time.Sleep(time.Second)
-				continue
-			}
-
-			switch listType {
-			case m3u8.MEDIA:
-				mediapl := p.(*m3u8.MediaPlaylist)
-
-				// Iterate through all segments in the playlist
-				for _, v := range mediapl.Segments {
-					if v != nil {
-						filePath := filepath.Join(hlsDir, v.URI)
-						segment, err := os.Open(filePath)
-						if err != nil {
-							continue
-						}
-
-						// Write to the HTTP ResponseWriter from the segment file
-						_, err = io.Copy(w, segment)
-						segment.Close()
-						if err != nil {
-							log.Println("Client disconnected:", err)
-							return
-					  }
-
-						// Delete the segment file
-						if err = os.Remove(filePath); err != nil {
-							log.Printf("Error deleting segment file: %v", err)
-						}
-					}
-				}
-			default:
-				log.Printf("Unknown playlist type.")
+		n, err := subscriber.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				log.Println("Client disconnected:", werr)
+				return
 			}
-
-			time.Sleep(time.Second)
+			w.Flush()
+			client.Sent(n)
 		}
-	}
-}
-
-func cleanupTsFiles(dir string, id string) error {
-	files, err := os.ReadDir(dir)
-	if err != nil {
-		return err
-	}
-
-	prefix := id + "-"
-	for _, f := range files {
-		if strings.HasPrefix(f.Name(), prefix) {
-			err := os.Remove(filepath.Join(dir, f.Name()))
-			if err != nil {
-				return err
-			}
+		if err == io.EOF {
+			log.Println("Stream ended for channel", tune.ChannelID)
+			return
 		}
 	}
-
-	// Deleting the m3u8 file
-	m3u8File := filepath.Join(dir, id+".m3u8")
-	err = os.Remove(m3u8File)
-	if err != nil {
-		return err
-	}
-
-	return nil
 }
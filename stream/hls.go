@@ -0,0 +1,206 @@
+package stream
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/grafov/m3u8"
+)
+
+const hlsDir = "./tmp"
+
+// An HLS session is stopped once no player asked for it during this time.
+const hlsIdleTimeout = 30 * time.Second
+
+// A player that polled within this time is still considered to be watching.
+const hlsViewerTimeout = 10 * time.Second
+
+// How long a playlist request waits for ffmpeg to write the first segments.
+const hlsStartTimeout = 20 * time.Second
+
+// Duration of each segment written by ffmpeg.
+const hlsSegmentTime = 2 * time.Second
+
+// TimeshiftWindow is the longest a player can rewind a timeshifted channel,
+// and the window used when it does not ask for a shorter one.
+var TimeshiftWindow = 30 * time.Minute
+
+// JoinHLS returns the running HLS session for the tune or starts a new one.
+func JoinHLS(tune Tune) (*Session, error) {
+	mutexSessions.Lock()
+	defer mutexSessions.Unlock()
+
+	session, err := openSession(tune, true)
+	if err != nil {
+		return nil, err
+	}
+	session.touch()
+
+	return session, nil
+}
+
+// FindHLS returns the running HLS session for the channel, profile,
+// timeshift window and variant, if any.
+func FindHLS(channelID string, profile string, timeshift time.Duration, variant string) *Session {
+	mutexSessions.Lock()
+	defer mutexSessions.Unlock()
+
+	return sessions[sessionKey(channelID, profile, true, timeshift, variant)]
+}
+
+func (s *Session) hlsPath() string {
+	return filepath.Join(hlsDir, s.Key)
+}
+
+// runHLS runs ffmpeg once, writing the playlist and segments to the session
+// directory until it exits.
+func (s *Session) runHLS(ctx context.Context, restarted bool) {
+	dir := s.hlsPath()
+
+	// After a restart keep numbering the segments where the last run stopped
+	hlsFlags := "delete_segments"
+	if restarted {
+		hlsFlags += "+append_list+discont_start"
+	}
+
+	// A timeshift session keeps the whole window on disk so players can seek back
+	listSize := 6
+	if s.Timeshift > 0 {
+		listSize = int(s.Timeshift / hlsSegmentTime)
+	}
+
+	args := append(ffmpegArgs(s.Profile, s.Source.InputURL),
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(int(hlsSegmentTime.Seconds())),
+		"-hls_list_size", strconv.Itoa(listSize),
+		"-hls_flags", hlsFlags,
+		"-hls_segment_filename", filepath.Join(dir, "%d.ts"),
+		filepath.Join(dir, "index.m3u8"),
+	)
+	cmd := exec.CommandContext(ctx, "./bin/ffmpeg", args...)
+	if err := cmd.Start(); err != nil {
+		log.Println("FFMPEG process couldn't start:", err)
+		return
+	}
+	s.setPID(cmd.Process.Pid)
+	defer s.setPID(0)
+
+	if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+		log.Println("FFMPEG process stopped unexpectedly:", err)
+	}
+}
+
+// HandleHLSPlaylist starts or joins the HLS session of the channel and returns
+// its live playlist with the segment URIs pointing back to us.
+func HandleHLSPlaylist(c *gin.Context, tune Tune) {
+	ctx := c.Request.Context()
+
+	session, err := JoinHLS(tune)
+	if err != nil {
+		log.Printf("Can't tune channel %s: %v", tune.ChannelID, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	registerHLS(session, c)
+
+	indexFile := filepath.Join(session.hlsPath(), "index.m3u8")
+	deadline := time.Now().Add(hlsStartTimeout)
+
+	var playlist *m3u8.MediaPlaylist
+	for {
+		playlist, err = readMediaPlaylist(indexFile)
+		if err == nil && playlist.Count() > 0 {
+			break
+		}
+
+		if session.isClosed() || time.Now().After(deadline) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Stream is not available"})
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+
+	// The segment requests need the profile and variant to find the session again
+	query := c.Request.URL.Query()
+	query.Set("profile", tune.Profile.Name)
+	if tune.Variant != "" {
+		query.Set("variant", tune.Variant)
+	}
+
+	for _, segment := range playlist.Segments {
+		if segment != nil {
+			segment.URI = fmt.Sprintf("/hls/%s/%s?%s", tune.ChannelID, filepath.Base(segment.URI), query.Encode())
+		}
+	}
+
+	// Announcing an EVENT playlist lets players seek back through the whole
+	// window, while ffmpeg keeps dropping what is older than it
+	if session.Timeshift > 0 {
+		playlist.MediaType = m3u8.EVENT
+		playlist.SetWinSize(0)
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, "application/vnd.apple.mpegurl", playlist.Encode().Bytes())
+}
+
+// HandleHLSSegment serves one segment of a running HLS session.
+func HandleHLSSegment(c *gin.Context, channelID string, profile string, timeshift time.Duration, variant string, segment string) {
+	if _, err := strconv.Atoi(strings.TrimSuffix(segment, ".ts")); err != nil || !strings.HasSuffix(segment, ".ts") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid segment"})
+		return
+	}
+
+	session := FindHLS(channelID, profile, timeshift, variant)
+	if session == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	session.touch()
+
+	segmentFile := filepath.Join(session.hlsPath(), segment)
+	if _, err := os.Stat(segmentFile); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Segment not found"})
+		return
+	}
+
+	client := registerHLS(session, c)
+
+	c.Header("Content-Type", "video/mp2t")
+	c.File(segmentFile)
+	client.Sent(c.Writer.Size())
+}
+
+func readMediaPlaylist(path string) (*m3u8.MediaPlaylist, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	p, listType, err := m3u8.DecodeFrom(bufio.NewReader(file), true)
+	if err != nil {
+		return nil, err
+	}
+
+	if listType != m3u8.MEDIA {
+		return nil, fmt.Errorf("unexpected playlist type in %s", path)
+	}
+
+	return p.(*m3u8.MediaPlaylist), nil
+}
@@ -0,0 +1,120 @@
+package stream
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// Profile tells ffmpeg how to transcode a channel. Empty codecs mean the
+// stream is copied as is.
+type Profile struct {
+	Name        string
+	VideoCodec  string
+	AudioCodec  string
+	Resolution  string
+	Bitrate     string
+	Deinterlace bool
+	ExtraArgs   []string
+}
+
+// ffmpegArgs builds the input and codec part of the command line for the
+// profile. The caller appends the output.
+func ffmpegArgs(profile Profile, inputURL string) []string {
+	args := []string{"-i", inputURL}
+
+	videoCodec := profile.VideoCodec
+	if videoCodec == "" {
+		videoCodec = "copy"
+	}
+	audioCodec := profile.AudioCodec
+	if audioCodec == "" {
+		audioCodec = "copy"
+	}
+
+	args = append(args, "-c:v", videoCodec, "-c:a", audioCodec)
+
+	// Filters can only be applied when the video is re-encoded
+	var filters []string
+	if profile.Deinterlace {
+		filters = append(filters, "yadif=mode=send_frame:parity=auto:deint=all")
+	}
+	if profile.Resolution != "" {
+		filters = append(filters, "scale="+strings.Replace(profile.Resolution, "x", ":", 1))
+	}
+	if len(filters) > 0 {
+		if videoCodec == "copy" {
+			log.Printf("Profile %s copies the video, ignoring deinterlace and resolution", profile.Name)
+		} else {
+			args = append(args, "-vf", strings.Join(filters, ","))
+		}
+	}
+
+	if profile.Bitrate != "" && videoCodec != "copy" {
+		args = append(args, "-b:v", profile.Bitrate, "-maxrate", profile.Bitrate)
+	}
+
+	args = append(args, "-sn")
+	if err := CheckExtraArgs(profile.ExtraArgs); err != nil {
+		log.Printf("Profile %s: ignoring its extra arguments, %v", profile.Name, err)
+		return args
+	}
+	return append(args, profile.ExtraArgs...)
+}
+
+// Encoder options a profile may add, each followed by its value. Stream
+// specifiers are accepted, so "b" allows -b:v and -b:a. Nothing taking a file,
+// a filter graph or another input is allowed, as the profile must not be able
+// to read or write anything but the stream.
+var extraArgOptions = map[string]bool{
+	"b": true, "maxrate": true, "minrate": true, "bufsize": true,
+	"crf": true, "qp": true, "q": true, "qmin": true, "qmax": true,
+	"preset": true, "tune": true, "profile": true, "level": true,
+	"g": true, "keyint_min": true, "sc_threshold": true, "bf": true, "refs": true,
+	"r": true, "pix_fmt": true, "fps_mode": true, "vsync": true, "threads": true,
+	"ar": true, "ac": true,
+	"x264opts": true, "x264-params": true, "x265-params": true,
+}
+
+// Keys of the x264 and x265 options naming a file to read or write
+var encoderFileParams = map[string]bool{
+	"stats": true, "dump_yuv": true, "dump-yuv": true, "qpfile": true, "cqmfile": true,
+	"tcfile-in": true, "tcfile-out": true, "csv": true, "recon": true, "zonefile": true,
+	"analysis-save": true, "analysis-load": true, "analysis-reuse-file": true,
+	"dolby-vision-rpu": true, "lambda-file": true, "scaling-list": true,
+}
+
+var extraArgOption = regexp.MustCompile(`^-([a-z0-9_-]+)(:[a-z0-9:]+)?$`)
+
+// CheckExtraArgs reports an error when the extra arguments of a profile are
+// anything but pairs of an allowed encoder option and its value.
+func CheckExtraArgs(extraArgs []string) error {
+	for i := 0; i < len(extraArgs); i += 2 {
+		match := extraArgOption.FindStringSubmatch(extraArgs[i])
+		if match == nil {
+			return fmt.Errorf("%q is not an option", extraArgs[i])
+		}
+		if !extraArgOptions[match[1]] {
+			return fmt.Errorf("the option %s is not allowed", extraArgs[i])
+		}
+		if i+1 == len(extraArgs) {
+			return fmt.Errorf("the option %s has no value", extraArgs[i])
+		}
+
+		value := extraArgs[i+1]
+		if strings.HasPrefix(value, "-") || strings.ContainsAny(value, `/\`) || strings.Contains(value, "file:") {
+			return fmt.Errorf("invalid value %q for %s", value, extraArgs[i])
+		}
+		if strings.HasSuffix(match[1], "opts") || strings.HasSuffix(match[1], "-params") {
+			for _, param := range strings.Split(value, ":") {
+				key, _, _ := strings.Cut(param, "=")
+				if encoderFileParams[key] {
+					return fmt.Errorf("the %s %s can't be set", extraArgs[i], key)
+				}
+			}
+		}
+	}
+
+	return nil
+}
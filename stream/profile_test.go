@@ -0,0 +1,46 @@
+package stream
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckExtraArgs(t *testing.T) {
+	tests := []struct {
+		args string
+		ok   bool
+	}{
+		{"", true},
+		{"-bufsize 1280k -sc_threshold 0 -keyint_min 75 -r 25 -pix_fmt yuv420p -preset veryfast -profile:v high -x264opts subme=0:me_range=4:rc_lookahead=10:partitions=none -crf 23", true},
+		{"-b:a 128k -ar 48000 -ac 2", true},
+		{"-x265-params keyint=50:bframes=3", true},
+		{"-y /etc/passwd", false},
+		{"-f mpegts file:/tmp/out.ts", false},
+		{"-i http://other/stream.ts", false},
+		{"/tmp/out.ts", false},
+		{"-crf 23 /tmp/out.ts", false},
+		{"-preset", false},
+		{"-preset -y", false},
+		{"-vf movie=x", false},
+		{"-map 0", false},
+		{"-pix_fmt ../out.ts", false},
+		{"-x264opts stats=log:pass=1", false},
+		{"-x265-params csv=out", false},
+	}
+
+	for _, test := range tests {
+		err := CheckExtraArgs(strings.Fields(test.args))
+		if (err == nil) != test.ok {
+			t.Errorf("%q: error %v, want ok %v", test.args, err, test.ok)
+		}
+	}
+}
+
+func TestFFmpegArgsDropInvalidExtraArgs(t *testing.T) {
+	args := ffmpegArgs(Profile{Name: "bad", ExtraArgs: []string{"-y", "/tmp/out.ts"}}, "http://provider/1.ts")
+	for _, arg := range args {
+		if arg == "/tmp/out.ts" {
+			t.Fatalf("extra arguments kept: %q", args)
+		}
+	}
+}
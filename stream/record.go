@@ -0,0 +1,49 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrStreamEnded is returned by Record when the session stops before the
+// recording is over.
+var ErrStreamEnded = errors.New("stream ended before the end of the recording")
+
+// Record joins the session of the tune like any other viewer and writes the
+// stream to w until the context is done. It returns the number of bytes
+// written. The recording shows up in the client registry under name.
+func Record(ctx context.Context, tune Tune, w io.Writer, name string) (int64, error) {
+	subscriber, err := Join(tune)
+	if err != nil {
+		return 0, err
+	}
+	defer subscriber.Close()
+
+	client := Register(subscriber.session, subscriber, "dvr", name)
+	defer client.Unregister()
+
+	go func() {
+		<-ctx.Done()
+		subscriber.Close()
+	}()
+
+	var written int64
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := subscriber.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return written, werr
+			}
+			written += int64(n)
+			client.Sent(n)
+		}
+		if err == io.EOF {
+			if ctx.Err() != nil {
+				return written, nil
+			}
+			return written, ErrStreamEnded
+		}
+	}
+}
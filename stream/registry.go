@@ -0,0 +1,190 @@
+package stream
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Client is one consumer of a session: a player pulling a TS stream, an HLS
+// player polling the playlist, or anything else reading from a session.
+type Client struct {
+	ID         string
+	RemoteAddr string
+	UserAgent  string
+	StartedAt  time.Time
+
+	session    *Session
+	subscriber *Subscriber
+	lastSeen   atomic.Int64
+	bytesSent  atomic.Int64
+}
+
+// ClientInfo is a snapshot of a client and the session it is watching.
+type ClientInfo struct {
+	ID         string
+	SessionKey string
+	ChannelID  string
+	PlaylistID uint
+	RemoteAddr string
+	UserAgent  string
+	Profile    string
+	Mode       string
+	StartedAt  time.Time
+	BytesSent  int64
+	Bitrate    int64
+	PID        int
+}
+
+var clients = make(map[string]*Client)
+var mutexClients = &sync.Mutex{}
+var lastClientID uint64
+
+// Register adds a client of the session to the registry. The subscriber is
+// nil for clients that do not hold a connection, like HLS players.
+func Register(session *Session, subscriber *Subscriber, remoteAddr string, userAgent string) *Client {
+	client := &Client{
+		ID:         strconv.FormatUint(atomic.AddUint64(&lastClientID, 1), 10),
+		RemoteAddr: remoteAddr,
+		UserAgent:  userAgent,
+		StartedAt:  time.Now(),
+		session:    session,
+		subscriber: subscriber,
+	}
+	client.lastSeen.Store(time.Now().UnixNano())
+
+	mutexClients.Lock()
+	clients[client.ID] = client
+	mutexClients.Unlock()
+
+	return client
+}
+
+// registerHLS returns the client of an HLS player, registering it on its
+// first request. Players are told apart by their address and user agent.
+func registerHLS(session *Session, c *gin.Context) *Client {
+	remoteAddr := c.ClientIP()
+	userAgent := c.Request.UserAgent()
+
+	mutexClients.Lock()
+	for _, client := range clients {
+		if client.session == session && client.subscriber == nil &&
+			client.RemoteAddr == remoteAddr && client.UserAgent == userAgent {
+			mutexClients.Unlock()
+			client.lastSeen.Store(time.Now().UnixNano())
+			return client
+		}
+	}
+	mutexClients.Unlock()
+
+	return Register(session, nil, remoteAddr, userAgent)
+}
+
+// Unregister removes the client from the registry.
+func (client *Client) Unregister() {
+	mutexClients.Lock()
+	defer mutexClients.Unlock()
+
+	delete(clients, client.ID)
+}
+
+// Sent accounts for bytes delivered to the client.
+func (client *Client) Sent(n int) {
+	client.bytesSent.Add(int64(n))
+}
+
+// gone reports whether the client can be dropped from the registry: its
+// session ended, or it is an HLS player that stopped polling.
+func (client *Client) gone() bool {
+	if client.session.isClosed() {
+		return true
+	}
+	if client.subscriber != nil {
+		return false
+	}
+	return time.Since(time.Unix(0, client.lastSeen.Load())) > hlsViewerTimeout
+}
+
+// Clients returns a snapshot of every registered client.
+func Clients() []ClientInfo {
+	mutexClients.Lock()
+	registered := make([]*Client, 0, len(clients))
+	for id, client := range clients {
+		if client.gone() {
+			delete(clients, id)
+			continue
+		}
+		registered = append(registered, client)
+	}
+	mutexClients.Unlock()
+
+	result := make([]ClientInfo, 0, len(registered))
+	for _, client := range registered {
+		result = append(result, client.info())
+	}
+
+	return result
+}
+
+func (client *Client) info() ClientInfo {
+	s := client.session
+
+	mode := "ts"
+	if s.HLS {
+		mode = "hls"
+	} else if s.Passthrough {
+		mode = "passthrough"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return ClientInfo{
+		ID:         client.ID,
+		SessionKey: s.Key,
+		ChannelID:  s.Source.ChannelID,
+		PlaylistID: s.Source.PlaylistID,
+		RemoteAddr: client.RemoteAddr,
+		UserAgent:  client.UserAgent,
+		Profile:    s.Profile.Name,
+		Mode:       mode,
+		StartedAt:  client.StartedAt,
+		BytesSent:  client.bytesSent.Load(),
+		Bitrate:    s.bitrate,
+		PID:        s.pid,
+	}
+}
+
+// Kill disconnects the client and reports whether it existed. When nobody
+// else is watching its session, the session is stopped right away so the
+// provider connection is released. HLS players can't be cut off one by one,
+// so killing one stops its whole session.
+func Kill(id string) bool {
+	mutexClients.Lock()
+	client, ok := clients[id]
+	if !ok {
+		mutexClients.Unlock()
+		return false
+	}
+	delete(clients, id)
+
+	alone := true
+	for _, other := range clients {
+		if other.session == client.session && !other.gone() {
+			alone = false
+			break
+		}
+	}
+	mutexClients.Unlock()
+
+	if alone || client.subscriber == nil {
+		client.session.Stop()
+	} else {
+		client.subscriber.Close()
+	}
+
+	return true
+}
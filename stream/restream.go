@@ -2,12 +2,18 @@ package stream
 
 import (
 	"context"
+	"io"
+	"log"
 	"net/http"
+	"strings"
 
 	"github.com/shaunschembri/restreamer/pkg/restream"
 )
 
-func StartRestreaming(ctx context.Context, url string, w http.ResponseWriter) error {
+// Sessions relaying the upstream as is use this profile
+var PassthroughProfile = Profile{Name: "passthrough"}
+
+func StartRestreaming(ctx context.Context, url string, w io.Writer) error {
 	restreamer := restream.Restream{
 		ReadBufferSize: 4096,
 		Writer:         w,
@@ -19,3 +25,47 @@ func StartRestreaming(ctx context.Context, url string, w http.ResponseWriter) er
 
 	return nil
 }
+
+// runPassthrough relays the upstream to the subscribers until it fails or the
+// context is cancelled. No ffmpeg is involved: plain TS streams are copied as
+// they come and HLS ones are joined into a TS stream by the restreamer.
+func (s *Session) runPassthrough(ctx context.Context) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, s.Source.InputURL, nil)
+	if err != nil {
+		log.Println("Invalid stream URL:", err)
+		return
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Println("Upstream request failed:", err)
+		}
+		return
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		log.Printf("Upstream returned %s for channel %s", response.Status, s.Source.ChannelID)
+		return
+	}
+
+	contentType := strings.ToLower(response.Header.Get("Content-Type"))
+	if !strings.Contains(contentType, "mpegurl") && !strings.HasSuffix(response.Request.URL.Path, ".m3u8") {
+		s.pump(response.Body)
+		return
+	}
+	response.Body.Close()
+
+	reader, writer := io.Pipe()
+	go func() {
+		err := StartRestreaming(ctx, s.Source.InputURL, writer)
+		if err != nil && ctx.Err() == nil {
+			log.Println("Restreaming stopped unexpectedly:", err)
+		}
+		writer.CloseWithError(err)
+	}()
+
+	s.pump(reader)
+	reader.Close()
+}
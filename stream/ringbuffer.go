@@ -0,0 +1,109 @@
+package stream
+
+import (
+	"io"
+	"sync"
+)
+
+// MPEG-TS packets are always 188 bytes long. When the buffer overflows we drop
+// whole packets so the reader never lands in the middle of one.
+const tsPacketSize = 188
+
+// Around 6MB per viewer, roughly 10 seconds of a high bitrate channel.
+const subscriberBufferSize = tsPacketSize * 32 * 1024
+
+// ringBuffer is a fixed size FIFO shared by one producer and one consumer.
+// Writes never block: if the consumer is too slow the oldest data is dropped.
+type ringBuffer struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	data    []byte
+	start   int
+	length  int
+	closed  bool
+	dropped int64
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	r := &ringBuffer{data: make([]byte, size)}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+func (r *ringBuffer) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	n := len(p)
+	size := len(r.data)
+
+	// Keep only the tail if the chunk alone does not fit
+	if len(p) > size {
+		skip := roundUpToPacket(len(p) - size)
+		r.dropped += int64(skip + r.length)
+		p = p[skip:]
+		r.start = 0
+		r.length = 0
+	}
+
+	// Make room by discarding the oldest packets
+	if overflow := r.length + len(p) - size; overflow > 0 {
+		overflow = roundUpToPacket(overflow)
+		if overflow > r.length {
+			overflow = r.length
+		}
+		r.start = (r.start + overflow) % size
+		r.length -= overflow
+		r.dropped += int64(overflow)
+	}
+
+	end := (r.start + r.length) % size
+	copied := copy(r.data[end:], p)
+	copy(r.data, p[copied:])
+	r.length += len(p)
+
+	r.cond.Broadcast()
+	return n, nil
+}
+
+// Read blocks until there is data available or the buffer is closed.
+func (r *ringBuffer) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for r.length == 0 && !r.closed {
+		r.cond.Wait()
+	}
+	if r.length == 0 {
+		return 0, io.EOF
+	}
+
+	n := len(p)
+	if n > r.length {
+		n = r.length
+	}
+
+	copied := copy(p[:n], r.data[r.start:])
+	copy(p[copied:n], r.data)
+	r.start = (r.start + n) % len(r.data)
+	r.length -= n
+
+	return n, nil
+}
+
+// Close wakes up any pending Read. Data already buffered can still be read.
+func (r *ringBuffer) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+	r.cond.Broadcast()
+}
+
+func roundUpToPacket(n int) int {
+	return (n + tsPacketSize - 1) / tsPacketSize * tsPacketSize
+}
@@ -0,0 +1,375 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// How long a session keeps ffmpeg running after its last viewer leaves, so
+// channel surfing back or a player reconnecting does not hit the provider again.
+const sessionLinger = 10 * time.Second
+
+// Session is a single ffmpeg process for a channel and profile whose output
+// is shared by every subscriber watching it. HLS sessions write their output
+// to disk instead and are kept alive by the player requests. Passthrough
+// sessions relay the upstream with the Go restreamer instead of ffmpeg.
+// Timeshift HLS sessions keep that much of the past on disk. Source changes on
+// failover with both mutexSessions and mu held, so either is enough to read it.
+type Session struct {
+	Key         string
+	ChannelID   string
+	Source      Source
+	Profile     Profile
+	HLS         bool
+	Passthrough bool
+	Timeshift   time.Duration
+	StartedAt   time.Time
+
+	mu          sync.Mutex
+	sources     []Source
+	sourceIndex int
+	subscribers map[*Subscriber]struct{}
+	cancel      context.CancelFunc
+	linger      *time.Timer
+	lastAccess  time.Time
+	closed      bool
+	done        chan struct{}
+
+	// Updated as ffmpeg produces data, see watchdog.go
+	bytesIn  int64
+	lastData time.Time
+	bitrate  int64
+
+	// PID of the running ffmpeg, zero when there is none
+	pid int
+}
+
+// Subscriber is one viewer of a session. Its buffer receives a copy of
+// everything ffmpeg produces from the moment it joined.
+type Subscriber struct {
+	session *Session
+	buffer  *ringBuffer
+	once    sync.Once
+}
+
+var sessions = make(map[string]*Session)
+var mutexSessions = &sync.Mutex{}
+
+func sessionKey(channelID string, profile string, hls bool, timeshift time.Duration, variant string) string {
+	key := channelID + "-" + profile
+	if hls {
+		key += "-hls"
+	}
+	if timeshift > 0 {
+		key += fmt.Sprintf("-timeshift%d", int(timeshift.Minutes()))
+	}
+	if variant != "" {
+		key += "-" + variant
+	}
+	return key
+}
+
+// Join subscribes to the running session for the channel and profile,
+// starting a new one if none exists yet. Starting a session fails with a
+// TunerLimitError when the playlist has no connection left.
+func Join(tune Tune) (*Subscriber, error) {
+	mutexSessions.Lock()
+	defer mutexSessions.Unlock()
+
+	session, err := openSession(tune, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return session.subscribe(), nil
+}
+
+// openSession returns the running session for the tune or starts a new one.
+// Must be called with mutexSessions held.
+func openSession(tune Tune, hls bool) (*Session, error) {
+	// Relayed and transcoded streams of a channel never share a session
+	if tune.Passthrough {
+		tune.Profile = PassthroughProfile
+	}
+
+	key := sessionKey(tune.ChannelID, tune.Profile.Name, hls, tune.Timeshift, tune.Variant)
+	session, ok := sessions[key]
+	if ok {
+		log.Printf("Joining session %s", key)
+		return session, nil
+	}
+
+	// Fall back to the failover sources when the primary has no tuner left
+	sources := append([]Source{tune.Source}, tune.Failover...)
+	var released []*Session
+	var err error
+	index := 0
+	for index = range sources {
+		released, err = reserveTuner(sources[index])
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	session = &Session{
+		Key:         key,
+		ChannelID:   tune.ChannelID,
+		Source:      sources[index],
+		Profile:     tune.Profile,
+		HLS:         hls,
+		Passthrough: tune.Passthrough,
+		Timeshift:   tune.Timeshift,
+		sources:     sources,
+		sourceIndex: index,
+		StartedAt:   time.Now(),
+		subscribers: make(map[*Subscriber]struct{}),
+		cancel:      cancel,
+		lastAccess:  time.Now(),
+		done:        make(chan struct{}),
+	}
+	sessions[key] = session
+	log.Printf("Starting session %s", key)
+	go func() {
+		waitReleased(released)
+		session.run(ctx)
+	}()
+
+	return session, nil
+}
+
+// Sessions returns a snapshot of the running sessions.
+func Sessions() []*Session {
+	mutexSessions.Lock()
+	defer mutexSessions.Unlock()
+
+	result := make([]*Session, 0, len(sessions))
+	for _, session := range sessions {
+		result = append(result, session)
+	}
+
+	return result
+}
+
+// Viewers returns the number of subscribers currently attached.
+func (s *Session) Viewers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.subscribers)
+}
+
+func (s *Session) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+// watched reports whether anybody is currently using the session.
+func (s *Session) watched() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.HLS {
+		return time.Since(s.lastAccess) < hlsViewerTimeout
+	}
+	return len(s.subscribers) > 0
+}
+
+func (s *Session) subscribe() *Subscriber {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subscriber := &Subscriber{
+		session: s,
+		buffer:  newRingBuffer(subscriberBufferSize),
+	}
+	if s.closed {
+		subscriber.buffer.Close()
+		return subscriber
+	}
+
+	if s.linger != nil {
+		s.linger.Stop()
+	}
+	s.subscribers[subscriber] = struct{}{}
+
+	return subscriber
+}
+
+func (s *Session) unsubscribe(subscriber *Subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.subscribers, subscriber)
+	if len(s.subscribers) == 0 {
+		// Reconnecting a passthrough is cheap, close the upstream right away
+		if s.Passthrough {
+			s.scheduleExpire(0)
+		} else {
+			s.scheduleExpire(sessionLinger)
+		}
+	}
+}
+
+// touch keeps an HLS session alive while the player keeps polling it.
+func (s *Session) touch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.scheduleExpire(hlsIdleTimeout)
+}
+
+// scheduleExpire must be called with s.mu held.
+func (s *Session) scheduleExpire(timeout time.Duration) {
+	if s.closed {
+		return
+	}
+
+	s.lastAccess = time.Now()
+	if s.linger == nil {
+		s.linger = time.AfterFunc(timeout, func() { s.expire(timeout) })
+	} else {
+		s.linger.Reset(timeout)
+	}
+}
+
+// expire stops the session if nobody used it during the timeout.
+func (s *Session) expire(timeout time.Duration) {
+	mutexSessions.Lock()
+	defer mutexSessions.Unlock()
+
+	s.mu.Lock()
+	idle := len(s.subscribers) == 0 && time.Since(s.lastAccess) >= timeout
+	s.mu.Unlock()
+
+	if idle {
+		log.Printf("No viewers left on session %s, stopping", s.Key)
+		s.stopLocked()
+	}
+}
+
+// Stop kills ffmpeg and disconnects every subscriber.
+func (s *Session) Stop() {
+	mutexSessions.Lock()
+	defer mutexSessions.Unlock()
+
+	s.stopLocked()
+}
+
+// stopLocked must be called with mutexSessions held.
+func (s *Session) stopLocked() {
+	if sessions[s.Key] == s {
+		delete(sessions, s.Key)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.cancel()
+	if s.linger != nil {
+		s.linger.Stop()
+	}
+	for subscriber := range s.subscribers {
+		subscriber.buffer.Close()
+	}
+}
+
+func (s *Session) setPID(pid int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pid = pid
+}
+
+func (s *Session) broadcast(p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.bytesIn += int64(len(p))
+	s.lastData = time.Now()
+	for subscriber := range s.subscribers {
+		subscriber.buffer.Write(p)
+	}
+}
+
+// runTS runs ffmpeg once, streaming its MPEG-TS output to the subscribers
+// until it exits.
+func (s *Session) runTS(ctx context.Context, restarted bool) {
+	args := ffmpegArgs(s.Profile, s.Source.InputURL)
+	if restarted {
+		// Tell the players the timestamps are about to jump
+		args = append(args, "-mpegts_flags", "+initial_discontinuity")
+	}
+	args = append(args, "-f", "mpegts", "pipe:1")
+
+	cmd := exec.CommandContext(ctx, "./bin/ffmpeg", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		log.Println("FFMPEG output pipe couldn't be created:", err)
+		return
+	}
+
+	if err := cmd.Start(); err != nil {
+		log.Println("FFMPEG process couldn't start:", err)
+		return
+	}
+	s.setPID(cmd.Process.Pid)
+	defer s.setPID(0)
+
+	// Stream the MPEG-TS output straight to the subscribers
+	s.pump(stdout)
+
+	if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+		log.Println("FFMPEG process stopped unexpectedly:", err)
+	}
+}
+
+// pump copies the ffmpeg output to every subscriber, always in whole TS packets
+// so a viewer joining late starts on a packet boundary.
+func (s *Session) pump(r io.Reader) error {
+	buf := make([]byte, tsPacketSize*348)
+	pending := 0
+
+	for {
+		n, err := r.Read(buf[pending:])
+		pending += n
+
+		aligned := pending - pending%tsPacketSize
+		if aligned > 0 {
+			s.broadcast(buf[:aligned])
+			pending = copy(buf, buf[aligned:pending])
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Read returns the next chunk of the stream, or io.EOF once the session is
+// over or the subscriber has been closed.
+func (sub *Subscriber) Read(p []byte) (int, error) {
+	return sub.buffer.Read(p)
+}
+
+// Close detaches the subscriber. It is safe to call more than once.
+func (sub *Subscriber) Close() {
+	sub.once.Do(func() {
+		sub.buffer.Close()
+		sub.session.unsubscribe(sub)
+	})
+}
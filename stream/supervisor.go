@@ -0,0 +1,146 @@
+package stream
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+)
+
+// Maximum number of times ffmpeg is restarted before the session gives up
+const maxRestarts = 5
+
+// The wait before each restart doubles from the initial to the max backoff
+const restartInitialBackoff = time.Second
+const restartMaxBackoff = 30 * time.Second
+
+// A run lasting longer than this is considered healthy and resets the budget
+const restartResetAfter = time.Minute
+
+// run supervises ffmpeg for the whole life of the session. When it exits while
+// the session is still wanted the next failover source is tried right away;
+// once every source failed it waits with an exponential backoff and starts
+// over. Subscribers stay attached across restarts, so their stream just
+// continues. Once the retry budget is exhausted the session stops and every
+// subscriber gets a clean end of stream.
+func (s *Session) run(ctx context.Context) {
+	defer close(s.done)
+	defer s.Stop()
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	if s.HLS {
+		dir := s.hlsPath()
+
+		// Remove anything a previous crash may have left behind
+		os.RemoveAll(dir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Printf("Failed to create HLS directory: %v", err)
+			return
+		}
+		defer os.RemoveAll(dir)
+	}
+
+	restarts := 0
+	restarted := false
+	backoff := restartInitialBackoff
+	tried := map[int]bool{s.sourceIndex: true}
+
+	for {
+		// The watchdog kills this run alone if the upstream stalls
+		runCtx, cancelRun := context.WithCancel(ctx)
+		s.resetActivity()
+		go s.watch(runCtx, cancelRun)
+
+		startedAt := time.Now()
+		if s.HLS {
+			s.runHLS(runCtx, restarted)
+		} else if s.Passthrough {
+			s.runPassthrough(runCtx)
+		} else {
+			s.runTS(runCtx, restarted)
+		}
+		cancelRun()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(startedAt) > restartResetAfter {
+			restarts = 0
+			backoff = restartInitialBackoff
+			tried = map[int]bool{s.sourceIndex: true}
+		}
+
+		restarted = true
+		if s.failover(tried) {
+			continue
+		}
+
+		if restarts >= maxRestarts {
+			log.Printf("Giving up on session %s after %d restarts", s.Key, restarts)
+			return
+		}
+		restarts++
+
+		log.Printf("Restarting session %s in %s (attempt %d/%d)", s.Key, backoff, restarts, maxRestarts)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > restartMaxBackoff {
+			backoff = restartMaxBackoff
+		}
+
+		// Start over from the primary source if it has a tuner available
+		tried = map[int]bool{}
+		if !s.failover(tried) {
+			tried[s.sourceIndex] = true
+		}
+	}
+}
+
+// failover switches the session to the first source not tried yet that has a
+// tuner available, and reports whether there was one.
+func (s *Session) failover(tried map[int]bool) bool {
+	mutexSessions.Lock()
+
+	for i, source := range s.sources {
+		if tried[i] {
+			continue
+		}
+		tried[i] = true
+
+		// Moving within the same playlist reuses the connection we already hold
+		var released []*Session
+		if source.PlaylistID != s.Source.PlaylistID {
+			var err error
+			released, err = reserveTuner(source)
+			if err != nil {
+				log.Printf("Can't fail over session %s to channel %s: %v", s.Key, source.ChannelID, err)
+				continue
+			}
+		}
+
+		if i != s.sourceIndex {
+			log.Printf("Failing over session %s from channel %s on playlist %d to channel %s on playlist %d",
+				s.Key, s.Source.ChannelID, s.Source.PlaylistID, source.ChannelID, source.PlaylistID)
+		}
+		s.mu.Lock()
+		s.Source = source
+		s.sourceIndex = i
+		s.mu.Unlock()
+		mutexSessions.Unlock()
+
+		waitReleased(released)
+		return true
+	}
+
+	mutexSessions.Unlock()
+	return false
+}
@@ -0,0 +1,41 @@
+package stream
+
+import (
+	"testing"
+)
+
+func TestFailoverWhileClientsAreListed(t *testing.T) {
+	s := &Session{
+		Key: "failover-test",
+		sources: []Source{
+			{ChannelID: "1", PlaylistID: 1},
+			{ChannelID: "2", PlaylistID: 2},
+		},
+		subscribers: make(map[*Subscriber]struct{}),
+		done:        make(chan struct{}),
+	}
+	s.Source = s.sources[0]
+	client := &Client{ID: "1", session: s}
+
+	// The clients page reads the source while the supervisor switches it
+	listed := make(chan struct{})
+	go func() {
+		defer close(listed)
+		for i := 0; i < 200; i++ {
+			if info := client.info(); info.ChannelID != "1" && info.ChannelID != "2" {
+				t.Errorf("client on channel %q", info.ChannelID)
+			}
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		if !s.failover(map[int]bool{i % 2: true}) {
+			t.Fatal("no source to fail over to")
+		}
+	}
+	<-listed
+
+	if s.Source.ChannelID != "1" || s.sourceIndex != 0 {
+		t.Errorf("session on channel %s, source %d, want channel 1, source 0", s.Source.ChannelID, s.sourceIndex)
+	}
+}
@@ -0,0 +1,132 @@
+package stream
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Source is one upstream a channel can be watched from and the provider
+// account the connection is made through.
+type Source struct {
+	ChannelID      string
+	PlaylistID     uint
+	MaxConnections int
+	PreemptOldest  bool
+	InputURL       string
+}
+
+// Tune describes what a viewer wants to watch. The session falls back to the
+// Failover sources, in order, when the primary one stops working. A Timeshift
+// window only applies to HLS. Variant tells apart sessions of the same channel
+// playing something else than the live stream, like catch-up.
+type Tune struct {
+	Source
+	Failover    []Source
+	Profile     Profile
+	Passthrough bool
+	Timeshift   time.Duration
+	Variant     string
+}
+
+// TunerLimitError is returned when starting a new upstream connection would
+// exceed the max_connections of the provider account.
+type TunerLimitError struct {
+	PlaylistID     uint
+	MaxConnections int
+}
+
+func (e *TunerLimitError) Error() string {
+	return fmt.Sprintf("all %d tuners of playlist %d are in use", e.MaxConnections, e.PlaylistID)
+}
+
+// How long a new session waits for a stopped one to release its connection.
+const tunerReleaseTimeout = 5 * time.Second
+
+// ActiveConnections returns the number of upstream connections currently open
+// on the given playlist.
+func ActiveConnections(playlistID uint) int {
+	mutexSessions.Lock()
+	defer mutexSessions.Unlock()
+
+	return len(playlistSessions(playlistID))
+}
+
+// playlistSessions must be called with mutexSessions held.
+func playlistSessions(playlistID uint) []*Session {
+	var result []*Session
+	for _, session := range sessions {
+		if session.Source.PlaylistID == playlistID {
+			result = append(result, session)
+		}
+	}
+
+	return result
+}
+
+// reserveTuner frees a connection slot on the playlist if needed, first from
+// sessions nobody is watching and then, when allowed, from the oldest ones.
+// Nothing is stopped unless a slot can be freed. It returns the sessions that
+// were stopped so the caller can wait for them.
+// Must be called with mutexSessions held.
+func reserveTuner(source Source) ([]*Session, error) {
+	if source.MaxConnections <= 0 {
+		return nil, nil
+	}
+
+	active := playlistSessions(source.PlaylistID)
+	needed := len(active) - source.MaxConnections + 1
+	if needed <= 0 {
+		return nil, nil
+	}
+
+	var idle, watched []*Session
+	for _, session := range active {
+		if session.watched() {
+			watched = append(watched, session)
+		} else {
+			idle = append(idle, session)
+		}
+	}
+
+	if len(idle) < needed && !source.PreemptOldest {
+		return nil, &TunerLimitError{PlaylistID: source.PlaylistID, MaxConnections: source.MaxConnections}
+	}
+
+	var released []*Session
+	for _, session := range idle {
+		if len(released) == needed {
+			return released, nil
+		}
+		log.Printf("Releasing idle session %s for a new tune on playlist %d", session.Key, source.PlaylistID)
+		session.stopLocked()
+		released = append(released, session)
+	}
+
+	sort.Slice(watched, func(i, j int) bool {
+		return watched[i].StartedAt.Before(watched[j].StartedAt)
+	})
+	for _, oldest := range watched {
+		if len(released) == needed {
+			break
+		}
+		log.Printf("Pre-empting session %s for a new tune on playlist %d", oldest.Key, source.PlaylistID)
+		oldest.stopLocked()
+		released = append(released, oldest)
+	}
+
+	return released, nil
+}
+
+// waitReleased blocks until the given sessions have closed their upstream.
+func waitReleased(released []*Session) {
+	timeout := time.After(tunerReleaseTimeout)
+	for _, session := range released {
+		select {
+		case <-session.done:
+		case <-timeout:
+			return
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// addTestSession registers a running session on the playlist, watched by one
+// subscriber or lingering without any.
+func addTestSession(t *testing.T, playlistID uint, age time.Duration, watched bool) *Session {
+	t.Helper()
+
+	s := &Session{
+		Key:         fmt.Sprintf("test-%d-%d", playlistID, len(sessions)),
+		Source:      Source{PlaylistID: playlistID},
+		StartedAt:   time.Now().Add(-age),
+		subscribers: make(map[*Subscriber]struct{}),
+		cancel:      func() {},
+		done:        make(chan struct{}),
+	}
+	if watched {
+		s.subscribers[&Subscriber{session: s, buffer: newRingBuffer(tsPacketSize)}] = struct{}{}
+	}
+	sessions[s.Key] = s
+	t.Cleanup(func() { delete(sessions, s.Key) })
+
+	return s
+}
+
+func TestReserveTuner(t *testing.T) {
+	tests := []struct {
+		name     string
+		preempt  bool
+		stopped  []bool
+		limitErr bool
+	}{
+		// Two to free with one idle session: nothing is stopped for nothing
+		{"no preemption", false, []bool{false, false, false, false}, true},
+		{"preemption", true, []bool{true, false, true, false}, false},
+	}
+
+	for _, test := range tests {
+		mutexSessions.Lock()
+		all := []*Session{
+			addTestSession(t, 1, time.Minute, false),
+			addTestSession(t, 1, time.Minute, true),
+			addTestSession(t, 1, time.Hour, true),
+			addTestSession(t, 2, 2*time.Hour, true),
+		}
+
+		released, err := reserveTuner(Source{PlaylistID: 1, MaxConnections: 2, PreemptOldest: test.preempt})
+		stopped := make([]bool, len(all))
+		for i, s := range all {
+			stopped[i] = s.isClosed()
+			s.stopLocked()
+		}
+		mutexSessions.Unlock()
+
+		var limitErr *TunerLimitError
+		if errors.As(err, &limitErr) != test.limitErr {
+			t.Errorf("%s: error %v", test.name, err)
+		}
+		if !reflect.DeepEqual(stopped, test.stopped) {
+			t.Errorf("%s: stopped %v, want %v", test.name, stopped, test.stopped)
+		}
+		if err == nil && len(released) != 2 {
+			t.Errorf("%s: %d sessions to wait for, want 2", test.name, len(released))
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package stream
+
+import (
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Headers relayed between the player and the provider so seeking works.
+var vodRequestHeaders = []string{"Range", "If-Range", "User-Agent"}
+var vodResponseHeaders = []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "Last-Modified", "ETag"}
+
+// HandleVOD proxies a movie or an episode from the provider. Unlike live TV
+// there is no session to share: every player seeks on its own, so the range
+// requests go straight to the upstream.
+func HandleVOD(c *gin.Context, url string) {
+	request, err := http.NewRequestWithContext(c.Request.Context(), c.Request.Method, url, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for _, header := range vodRequestHeaders {
+		if value := c.GetHeader(header); value != "" {
+			request.Header.Set(header, value)
+		}
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		log.Println("VOD request failed:", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	defer response.Body.Close()
+
+	for _, header := range vodResponseHeaders {
+		if value := response.Header.Get(header); value != "" {
+			c.Header(header, value)
+		}
+	}
+	c.Status(response.StatusCode)
+
+	if _, err := io.Copy(c.Writer, response.Body); err != nil && c.Request.Context().Err() == nil {
+		log.Println("VOD stream stopped:", err)
+	}
+}
@@ -0,0 +1,102 @@
+package stream
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// StallTimeout is how long a session may go without receiving data from
+// ffmpeg before it is killed and restarted or failed over. Zero disables it.
+var StallTimeout = 20 * time.Second
+
+// watch checks every second that ffmpeg keeps producing data, and cancels the
+// run when nothing arrived for StallTimeout. For HLS sessions the data is the
+// newest segment showing up in the playlist.
+func (s *Session) watch(ctx context.Context, cancel context.CancelFunc) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	lastSeq := -1
+	lastBytes := int64(0)
+	lastTick := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if s.HLS {
+			lastSeq = s.collectSegments(lastSeq)
+		}
+
+		s.mu.Lock()
+		now := time.Now()
+		instant := (s.bytesIn - lastBytes) * 8 * int64(time.Second) / int64(now.Sub(lastTick))
+		s.bitrate = (s.bitrate*4 + instant) / 5
+		lastBytes = s.bytesIn
+		lastTick = now
+		idle := now.Sub(s.lastData)
+		source := s.Source
+		s.mu.Unlock()
+
+		if StallTimeout > 0 && idle > StallTimeout {
+			log.Printf("Session %s stalled on channel %s of playlist %d: no data for %s",
+				s.Key, source.ChannelID, source.PlaylistID, idle.Round(time.Second))
+			cancel()
+			return
+		}
+	}
+}
+
+// resetActivity gives a new ffmpeg run the full timeout to start producing.
+func (s *Session) resetActivity() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastData = time.Now()
+}
+
+// collectSegments accounts for the segments added to the HLS playlist since
+// lastSeq and returns the sequence number of the newest one.
+func (s *Session) collectSegments(lastSeq int) int {
+	dir := s.hlsPath()
+	playlist, err := readMediaPlaylist(filepath.Join(dir, "index.m3u8"))
+	if err != nil {
+		return lastSeq
+	}
+
+	newest := lastSeq
+	var size int64
+	for _, segment := range playlist.Segments {
+		if segment == nil || int(segment.SeqId) <= lastSeq {
+			continue
+		}
+
+		if info, err := os.Stat(filepath.Join(dir, filepath.Base(segment.URI))); err == nil {
+			size += info.Size()
+		}
+		newest = int(segment.SeqId)
+	}
+
+	if newest > lastSeq {
+		s.mu.Lock()
+		s.bytesIn += size
+		s.lastData = time.Now()
+		s.mu.Unlock()
+	}
+
+	return newest
+}
+
+// Bitrate returns the recent input bitrate of the session in bits per second.
+func (s *Session) Bitrate() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.bitrate
+}